@@ -0,0 +1,68 @@
+package cbor
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// CBOR default CBOR codec. Struct fields are named by their cbor tag, else
+// by their json tag, else by their name. Times keep their nanoseconds, and
+// maps are decoded into an interface{} as map[string]interface{}.
+var CBOR encoding.Codec = newCBOR()
+
+func init() {
+	encoding.Register(encoding.IDCBOR, "cbor", CBOR)
+}
+
+type cborx struct {
+	enc cbor.UserBufferEncMode
+	dec cbor.DecMode
+}
+
+func newCBOR() *cborx {
+	enc, err := cbor.EncOptions{
+		Time:    cbor.TimeRFC3339Nano,
+		TimeTag: cbor.EncTagRequired,
+	}.UserBufferEncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return &cborx{enc: enc, dec: dec}
+}
+
+var buffers = sync.Pool{New: func() interface{} {
+	return new(bytes.Buffer)
+}}
+
+// maxPooledSize bounds the buffers kept in the pool, so that a large value
+// does not pin its buffer.
+const maxPooledSize = 64 * 1024
+
+func (c *cborx) Marshal(v interface{}) ([]byte, error) {
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	err := c.enc.MarshalToBuffer(v, buf)
+	var data []byte
+	if err == nil {
+		data = bytes.Clone(buf.Bytes())
+	}
+	if buf.Cap() <= maxPooledSize {
+		buffers.Put(buf)
+	}
+	return data, err
+}
+
+func (c *cborx) Unmarshal(data []byte, v interface{}) error {
+	return c.dec.Unmarshal(data, v)
+}
@@ -0,0 +1,72 @@
+package cbor
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type session struct {
+	ID      string            `cbor:"id"`
+	UserID  int64             `json:"uid"`
+	Roles   []string          `cbor:"roles,omitempty"`
+	Data    map[string]string `cbor:"data"`
+	Expires time.Time         `cbor:"exp"`
+	Secret  string            `cbor:"-"`
+}
+
+func TestCodec(t *testing.T) {
+	s := session{
+		ID:      "abc",
+		UserID:  1 << 40,
+		Data:    map[string]string{"k": "v"},
+		Expires: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Secret:  "secret",
+	}
+	data, err := CBOR.Marshal(s)
+	assert.NoError(t, err)
+	var fields map[string]interface{}
+	assert.NoError(t, cbor.Unmarshal(data, &fields))
+	assert.Contains(t, fields, "id")
+	assert.Contains(t, fields, "uid", "json tags are the fallback")
+	assert.NotContains(t, fields, "roles")
+	assert.NotContains(t, fields, "Secret")
+
+	var recv session
+	assert.NoError(t, CBOR.Unmarshal(data, &recv))
+	s.Secret = ""
+	assert.Equal(t, s, recv)
+
+	var v interface{}
+	assert.NoError(t, CBOR.Unmarshal(data, &v))
+	m, ok := v.(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "abc", m["id"])
+	assert.Equal(t, s.Expires, m["exp"])
+
+	assert.Error(t, CBOR.Unmarshal([]byte{0xff}, &v))
+	_, err = CBOR.Marshal(make(chan int))
+	assert.Error(t, err)
+}
+
+func TestConcurrency(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				in := session{ID: "s", UserID: int64(i*1000 + j)}
+				data, err := CBOR.Marshal(in)
+				assert.NoError(t, err)
+				var out session
+				assert.NoError(t, CBOR.Unmarshal(data, &out))
+				assert.Equal(t, in.UserID, out.UserID)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
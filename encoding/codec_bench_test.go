@@ -0,0 +1,133 @@
+package encoding_test
+
+import (
+	stdgob "encoding/gob"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/encoding/cbor"
+	"github.com/admpub/cache/encoding/gob"
+	"github.com/admpub/cache/encoding/json"
+	"github.com/admpub/cache/encoding/msgpack"
+)
+
+// Representative cache payloads: a small session, a large document and a
+// dynamic map.
+
+type session struct {
+	ID      string            `json:"id"`
+	UserID  int64             `json:"uid"`
+	Roles   []string          `json:"roles"`
+	Data    map[string]string `json:"data"`
+	Expires time.Time         `json:"exp"`
+}
+
+type comment struct {
+	Author  string    `json:"author"`
+	Body    string    `json:"body"`
+	Likes   int       `json:"likes"`
+	Created time.Time `json:"created"`
+}
+
+type document struct {
+	ID       int64     `json:"id"`
+	Title    string    `json:"title"`
+	Body     string    `json:"body"`
+	Tags     []string  `json:"tags"`
+	Score    float64   `json:"score"`
+	Comments []comment `json:"comments"`
+}
+
+func payloads() map[string]func() interface{} {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := &document{
+		ID:    42,
+		Title: "A representative document",
+		Body:  strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit. ", 40),
+		Tags:  []string{"cache", "codec", "benchmark"},
+		Score: 4.5,
+	}
+	for i := 0; i < 50; i++ {
+		doc.Comments = append(doc.Comments, comment{Author: fmt.Sprintf("user%d", i), Body: "Nice one", Likes: i, Created: at})
+	}
+	return map[string]func() interface{}{
+		"session": func() interface{} {
+			return &session{ID: "0f8fad5b-d9cb-469f-a165-70867728950e", UserID: 1001, Roles: []string{"admin", "editor"}, Data: map[string]string{"lang": "en", "theme": "dark"}, Expires: at}
+		},
+		"document": func() interface{} { return doc },
+		"map": func() interface{} {
+			return map[string]interface{}{"id": 7, "name": "widget", "price": 9.99, "stock": true, "tags": []interface{}{"a", "b"}}
+		},
+	}
+}
+
+func init() {
+	// gob needs the types held by interface{} values.
+	stdgob.Register([]interface{}{})
+}
+
+var codecs = []struct {
+	name  string
+	codec encoding.Codec
+}{
+	{"json", json.JSON},
+	{"gob", gob.GOB},
+	{"msgpack", msgpack.MsgPack},
+	{"cbor", cbor.CBOR},
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	for name, payload := range payloads() {
+		for _, c := range codecs {
+			b.Run(name+"/"+c.name, func(b *testing.B) {
+				v := payload()
+				data, err := c.codec.Marshal(v)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ReportMetric(float64(len(data)), "bytes")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.codec.Marshal(v); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for name, payload := range payloads() {
+		for _, c := range codecs {
+			b.Run(name+"/"+c.name, func(b *testing.B) {
+				v := payload()
+				data, err := c.codec.Marshal(v)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// A fresh value of the same type, as a cache read does.
+					var out interface{}
+					switch v.(type) {
+					case *session:
+						out = &session{}
+					case *document:
+						out = &document{}
+					default:
+						out = &map[string]interface{}{}
+					}
+					if err := c.codec.Unmarshal(data, out); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Gzip compresses with gzip at the default level.
+var Gzip Compressor = NewGzip(gzip.DefaultCompression)
+
+// Snappy compresses with snappy, faster than gzip but less tightly.
+var Snappy Compressor = snappyx{}
+
+type gzipx struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewGzip returns a gzip compressor at level, from gzip.HuffmanOnly to
+// gzip.BestCompression. Its payloads are decoded by any gzip compressor.
+func NewGzip(level int) Compressor {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic("cache/compress: " + err.Error())
+	}
+	return &gzipx{level: level}
+}
+
+func (g *gzipx) ID() byte {
+	return GzipID
+}
+
+func (g *gzipx) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, ok := g.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w, _ = gzip.NewWriterLevel(buf, g.level)
+	}
+	defer g.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipx) Decompress(src []byte) ([]byte, error) {
+	var err error
+	r, ok := g.readers.Get().(*gzip.Reader)
+	if ok {
+		err = r.Reset(bytes.NewReader(src))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer g.readers.Put(r)
+	return io.ReadAll(r)
+}
+
+type snappyx struct{}
+
+func (snappyx) ID() byte {
+	return SnappyID
+}
+
+func (snappyx) Compress(dst, src []byte) ([]byte, error) {
+	size := snappy.MaxEncodedLen(len(src))
+	if size < 0 {
+		return nil, snappy.ErrTooLarge
+	}
+	n := len(dst)
+	dst = append(dst, make([]byte, size)...)
+	return dst[:n+len(snappy.Encode(dst[n:], src))], nil
+}
+
+func (snappyx) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,155 @@
+// Package compress wraps a codec to compress the large payloads it encodes.
+//
+// Every payload starts with a header of two magic bytes and a byte naming
+// the algorithm it is compressed with, or None, so that payloads written
+// with different thresholds or algorithms can be read back by any Codec of
+// this package. Payloads without the header, written before the codec was
+// wrapped, are decoded by the wrapped codec or a fallback, e.g. when a cache
+// of JSON entries moves to compressed gob:
+//
+//	c.SetCodec(compress.New(gob.GOB, compress.Snappy, compress.DefaultThreshold).WithFallback(json.JSON))
+package compress
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// Magic starts every payload. Neither JSON nor gob payloads start with its
+// first byte; the binary payloads of other codecs which start with the
+// magic bytes and a registered algorithm are misread, so such codecs
+// should be wrapped from the start rather than given as a fallback.
+var Magic = [2]byte{0xCA, 0xC7}
+
+// HeaderSize is the size of the header of the payloads.
+const HeaderSize = 3
+
+// None is the algorithm byte of the payloads stored uncompressed.
+const None byte = 0
+
+// Algorithm bytes of the built-in algorithms. The IDs from 128 on are left to
+// the algorithms registered by applications, such as zstd.
+const (
+	GzipID   byte = 1
+	SnappyID byte = 2
+)
+
+// DefaultThreshold is the payload size, in bytes, from which compression
+// usually pays off.
+const DefaultThreshold = 1024
+
+// Compressor is a compression algorithm.
+type Compressor interface {
+	// ID returns the algorithm byte of the payloads it compresses.
+	ID() byte
+	// Compress appends the compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress returns the decompressed src.
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	mu          sync.RWMutex
+	compressors = map[byte]Compressor{}
+)
+
+// Register makes a compressor available to decode the payloads whose
+// algorithm byte is its ID, replacing the one registered with the same ID.
+func Register(c Compressor) {
+	if c.ID() == None {
+		panic("cache/compress: compressor ID 0 is reserved")
+	}
+	mu.Lock()
+	compressors[c.ID()] = c
+	mu.Unlock()
+}
+
+func lookup(id byte) (Compressor, bool) {
+	mu.RLock()
+	c, ok := compressors[id]
+	mu.RUnlock()
+	return c, ok
+}
+
+func init() {
+	Register(Gzip)
+	Register(Snappy)
+}
+
+// Codec encodes values with the codec it wraps and compresses the payloads
+// of at least threshold bytes. Payloads which do not shrink are stored
+// uncompressed.
+type Codec struct {
+	codec      encoding.Codec
+	fallback   encoding.Codec
+	compressor Compressor
+	threshold  int
+}
+
+var _ encoding.Codec = (*Codec)(nil)
+
+// New returns a codec compressing the payloads of codec with compressor
+// from threshold bytes on, e.g. New(json.JSON, compress.Snappy, compress.DefaultThreshold).
+// The compressor is registered for decoding unless its ID already is. The
+// payloads without a header are decoded with codec too, unless WithFallback
+// names another one.
+func New(codec encoding.Codec, compressor Compressor, threshold int) *Codec {
+	if _, ok := lookup(compressor.ID()); !ok {
+		Register(compressor)
+	}
+	return &Codec{codec: codec, fallback: codec, compressor: compressor, threshold: threshold}
+}
+
+// WithFallback sets the codec decoding the payloads without a header,
+// written before the codec was wrapped.
+func (c *Codec) WithFallback(codec encoding.Codec) *Codec {
+	c.fallback = codec
+	return c
+}
+
+// compressed reports whether data starts with the header of this package.
+func compressed(data []byte) bool {
+	return len(data) >= HeaderSize && data[0] == Magic[0] && data[1] == Magic[1]
+}
+
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= c.threshold {
+		b := make([]byte, HeaderSize, len(data)/2+HeaderSize)
+		b[0], b[1], b[2] = Magic[0], Magic[1], c.compressor.ID()
+		if b, err = c.compressor.Compress(b, data); err != nil {
+			return nil, err
+		}
+		if len(b) < len(data)+HeaderSize {
+			return b, nil
+		}
+	}
+	b := make([]byte, len(data)+HeaderSize)
+	b[0], b[1], b[2] = Magic[0], Magic[1], None
+	copy(b[HeaderSize:], data)
+	return b, nil
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	if !compressed(data) {
+		return c.fallback.Unmarshal(data, v)
+	}
+	id := data[HeaderSize-1]
+	if id == None {
+		return c.codec.Unmarshal(data[HeaderSize:], v)
+	}
+	compressor, ok := lookup(id)
+	if !ok {
+		return fmt.Errorf("cache/compress: unknown compression algorithm %d", id)
+	}
+	data, err := compressor.Decompress(data[HeaderSize:])
+	if err != nil {
+		return fmt.Errorf("cache/compress: error decompressing: %w", err)
+	}
+	return c.codec.Unmarshal(data, v)
+}
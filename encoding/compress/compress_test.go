@@ -0,0 +1,135 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/encoding/gob"
+	"github.com/admpub/cache/encoding/json"
+)
+
+type document struct {
+	Title string
+	Body  string
+}
+
+func TestCodec(t *testing.T) {
+	large := document{Title: "large", Body: strings.Repeat("lorem ipsum dolor sit amet ", 200)}
+	small := document{Title: "small", Body: "short"}
+	for _, compressor := range []Compressor{Gzip, NewGzip(9), Snappy} {
+		for _, codec := range []*Codec{New(json.JSON, compressor, 256), New(gob.GOB, compressor, 256)} {
+			data, err := codec.Marshal(large)
+			assert.NoError(t, err)
+			assert.Equal(t, compressor.ID(), data[2])
+			plain, _ := codec.codec.Marshal(large)
+			assert.Less(t, len(data), len(plain)/4)
+			var recv document
+			assert.NoError(t, codec.Unmarshal(data, &recv))
+			assert.Equal(t, large, recv)
+
+			data, err = codec.Marshal(small)
+			assert.NoError(t, err)
+			assert.Equal(t, None, data[2])
+			recv = document{}
+			assert.NoError(t, codec.Unmarshal(data, &recv))
+			assert.Equal(t, small, recv)
+		}
+	}
+}
+
+func TestMixedPayloads(t *testing.T) {
+	large := strings.Repeat("a", 4096)
+	gzipped, err := New(json.JSON, Gzip, 0).Marshal(large)
+	assert.NoError(t, err)
+	snappied, err := New(json.JSON, Snappy, 0).Marshal(large)
+	assert.NoError(t, err)
+	raw, err := New(json.JSON, Snappy, 1<<20).Marshal(large)
+	assert.NoError(t, err)
+	assert.Equal(t, None, raw[2])
+
+	codec := New(json.JSON, Gzip, DefaultThreshold)
+	for _, data := range [][]byte{gzipped, snappied, raw} {
+		var recv string
+		assert.NoError(t, codec.Unmarshal(data, &recv))
+		assert.Equal(t, large, recv)
+	}
+
+	// Incompressible payloads are stored as they are.
+	random := make([]byte, 4096)
+	rand.Read(random)
+	data, err := codec.Marshal(random)
+	assert.NoError(t, err)
+	assert.Equal(t, None, data[2])
+
+	var recv string
+	assert.EqualError(t, codec.Unmarshal([]byte{Magic[0], Magic[1], 99, 'x'}, &recv), "cache/compress: unknown compression algorithm 99")
+	assert.Error(t, codec.Unmarshal([]byte{Magic[0], Magic[1], GzipID, 'x'}, &recv))
+}
+
+func TestLegacyPayloads(t *testing.T) {
+	doc := document{Title: "legacy", Body: strings.Repeat("lorem ipsum ", 200)}
+	// Entries written before the codec was wrapped have no header.
+	for _, legacy := range []encoding.Codec{json.JSON, gob.GOB} {
+		data, err := legacy.Marshal(doc)
+		assert.NoError(t, err)
+		var recv document
+		assert.NoError(t, New(legacy, Snappy, 0).Unmarshal(data, &recv))
+		assert.Equal(t, doc, recv)
+	}
+
+	data, err := json.JSON.Marshal(doc)
+	assert.NoError(t, err)
+	codec := New(gob.GOB, Gzip, 0).WithFallback(json.JSON)
+	var recv document
+	assert.NoError(t, codec.Unmarshal(data, &recv))
+	assert.Equal(t, doc, recv)
+	data, err = codec.Marshal(doc)
+	assert.NoError(t, err)
+	recv = document{}
+	assert.NoError(t, codec.Unmarshal(data, &recv))
+	assert.Equal(t, doc, recv)
+}
+
+// deflate is a compressor registered by the application.
+type deflate struct{}
+
+func (deflate) ID() byte {
+	return 200
+}
+
+func (deflate) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	w.Write(src)
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+func (deflate) Decompress(src []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(src)))
+}
+
+func TestRegister(t *testing.T) {
+	large := strings.Repeat("b", 4096)
+	data, err := New(json.JSON, deflate{}, 0).Marshal(large)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(200), data[2])
+
+	var recv string
+	assert.NoError(t, New(json.JSON, Snappy, 0).Unmarshal(data, &recv))
+	assert.Equal(t, large, recv)
+	assert.Panics(t, func() { Register(noneCompressor{}) })
+}
+
+type noneCompressor struct{ deflate }
+
+func (noneCompressor) ID() byte {
+	return None
+}
@@ -0,0 +1,207 @@
+// Package encrypt wraps a codec to encrypt the payloads it encodes with
+// AES-GCM.
+//
+// A payload starts with a version byte and the ID of the key it is
+// encrypted with, so that the values written before a key rotation stay
+// readable while the keyring holds their key:
+//
+//	keys := encrypt.NewKeyring()
+//	keys.Add(1, oldKey)
+//	keys.Add(2, newKey) // the highest ID encrypts the new values
+//	c.SetCodec(encrypt.New(json.JSON, keys))
+//
+// Once the values encrypted with key 1 have expired or been rewritten,
+// keys.Remove(1) retires it. To compress the payloads as well, wrap the
+// compressing codec, as encrypted data does not compress.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// version is the first byte of the payloads.
+const version byte = 1
+
+// headerSize is the size of the version byte and key ID.
+const headerSize = 1 + 4
+
+var (
+	// ErrNoKey is returned when encrypting with an empty keyring.
+	ErrNoKey = errors.New("cache/encrypt: no key")
+	// ErrDecrypt is returned for payloads which are not authentic, e.g.
+	// corrupted or encrypted with another key of the same ID.
+	ErrDecrypt = errors.New("cache/encrypt: message authentication failed")
+)
+
+// Keyring holds the keys of a Codec, identified by IDs. The key of the
+// highest ID encrypts, and every key decrypts. It is safe for concurrent
+// use, so keys can be rotated while the codec is in use.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[uint32]cipher.AEAD
+	newest uint32
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[uint32]cipher.AEAD{}}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cache/encrypt: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cache/encrypt: %w", err)
+	}
+	return aead, nil
+}
+
+// add adds aead under id. k.mu must be held.
+func (k *Keyring) add(id uint32, aead cipher.AEAD) {
+	k.keys[id] = aead
+	if len(k.keys) == 1 || id > k.newest {
+		k.newest = id
+	}
+}
+
+// Add adds key, of 16, 24 or 32 bytes for AES-128, AES-192 or AES-256,
+// under id, replacing the key of the same ID.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.add(id, aead)
+	k.mu.Unlock()
+	return nil
+}
+
+// Rotate adds key under the ID following the newest one, which it then
+// replaces for encryption, and returns that ID.
+func (k *Keyring) Rotate(key []byte) (uint32, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id := uint32(1)
+	if len(k.keys) > 0 {
+		id = k.newest + 1
+	}
+	k.add(id, aead)
+	return id, nil
+}
+
+// Remove removes the key of id, after which the payloads encrypted with it
+// cannot be decrypted.
+func (k *Keyring) Remove(id uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+	if id != k.newest {
+		return
+	}
+	k.newest = 0
+	for id := range k.keys {
+		if id > k.newest {
+			k.newest = id
+		}
+	}
+}
+
+// Newest returns the ID of the key which encrypts, and false if the
+// keyring is empty.
+func (k *Keyring) Newest() (uint32, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.newest, len(k.keys) > 0
+}
+
+func (k *Keyring) encrypter() (uint32, cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return 0, nil, ErrNoKey
+	}
+	return k.newest, k.keys[k.newest], nil
+}
+
+func (k *Keyring) key(id uint32) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[id]
+	return aead, ok
+}
+
+// Codec encodes values with the codec it wraps and encrypts the payloads
+// with the keys of a Keyring.
+type Codec struct {
+	codec encoding.Codec
+	keys  *Keyring
+}
+
+var _ encoding.Codec = (*Codec)(nil)
+
+// New returns a codec encrypting the payloads of codec with keys.
+func New(codec encoding.Codec, keys *Keyring) *Codec {
+	return &Codec{codec: codec, keys: keys}
+}
+
+// Marshal encodes v and encrypts it with the newest key, under a random
+// nonce. The header is authenticated along with the payload.
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	id, aead, err := c.keys.encrypter()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	b := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(data)+aead.Overhead())
+	b[0] = version
+	binary.BigEndian.PutUint32(b[1:headerSize], id)
+	nonce := b[headerSize:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, nonce, data, b[:headerSize]), nil
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return c.codec.Unmarshal(data, v)
+	}
+	if len(data) < headerSize || data[0] != version {
+		return fmt.Errorf("cache/encrypt: invalid payload")
+	}
+	id := binary.BigEndian.Uint32(data[1:headerSize])
+	aead, ok := c.keys.key(id)
+	if !ok {
+		return fmt.Errorf("cache/encrypt: unknown key %d", id)
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < headerSize+nonceSize+aead.Overhead() {
+		return fmt.Errorf("cache/encrypt: invalid payload")
+	}
+	nonce := data[headerSize : headerSize+nonceSize]
+	plain, err := aead.Open(nil, nonce, data[headerSize+nonceSize:], data[:headerSize])
+	if err != nil {
+		return ErrDecrypt
+	}
+	return c.codec.Unmarshal(plain, v)
+}
@@ -0,0 +1,135 @@
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding/compress"
+	"github.com/admpub/cache/encoding/gob"
+	"github.com/admpub/cache/encoding/json"
+)
+
+type user struct {
+	Name  string
+	Email string
+}
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestCodec(t *testing.T) {
+	keys := NewKeyring()
+	_, ok := keys.Newest()
+	assert.False(t, ok)
+	_, err := New(json.JSON, keys).Marshal("value")
+	assert.Equal(t, ErrNoKey, err)
+	assert.Error(t, keys.Add(1, []byte("short")))
+
+	assert.NoError(t, keys.Add(1, key(1)))
+	u := user{Name: "A", Email: "a@example.com"}
+	for _, codec := range []*Codec{New(json.JSON, keys), New(gob.GOB, keys), New(compress.New(json.JSON, compress.Snappy, 0), keys)} {
+		data, err := codec.Marshal(u)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), u.Email)
+		var recv user
+		assert.NoError(t, codec.Unmarshal(data, &recv))
+		assert.Equal(t, u, recv)
+
+		again, err := codec.Marshal(u)
+		assert.NoError(t, err)
+		assert.NotEqual(t, data, again, "nonces are random")
+	}
+
+	codec := New(json.JSON, keys)
+	data, err := codec.Marshal(u)
+	assert.NoError(t, err)
+	var recv user
+	for i := range data {
+		altered := append([]byte(nil), data...)
+		altered[i] ^= 1
+		assert.Error(t, codec.Unmarshal(altered, &recv), "byte %d", i)
+	}
+	assert.Equal(t, ErrDecrypt, codec.Unmarshal(append(data[:len(data)-1:len(data)-1], data[len(data)-1]^1), &recv))
+	assert.EqualError(t, codec.Unmarshal(data[:10], &recv), "cache/encrypt: invalid payload")
+
+	// A key of the same ID does not decrypt the payloads of another one.
+	other := NewKeyring()
+	assert.NoError(t, other.Add(1, key(9)))
+	assert.Equal(t, ErrDecrypt, New(json.JSON, other).Unmarshal(data, &recv))
+}
+
+func TestRotation(t *testing.T) {
+	keys := NewKeyring()
+	codec := New(json.JSON, keys)
+	id, err := keys.Rotate(key(1))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), id)
+	old, err := codec.Marshal("old")
+	assert.NoError(t, err)
+
+	id, err = keys.Rotate(key(2))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), id)
+	current, err := codec.Marshal("new")
+	assert.NoError(t, err)
+
+	// Adding an older key does not change the key which encrypts.
+	assert.NoError(t, keys.Add(0, key(3)))
+	id, ok := keys.Newest()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), id)
+
+	var s string
+	assert.NoError(t, codec.Unmarshal(old, &s))
+	assert.Equal(t, "old", s)
+	assert.NoError(t, codec.Unmarshal(current, &s))
+	assert.Equal(t, "new", s)
+
+	keys.Remove(1)
+	assert.EqualError(t, codec.Unmarshal(old, &s), "cache/encrypt: unknown key 1")
+	keys.Remove(2)
+	id, _ = keys.Newest()
+	assert.Equal(t, uint32(0), id, "the newest of the remaining keys encrypts")
+	data, err := codec.Marshal("value")
+	assert.NoError(t, err)
+	assert.NoError(t, codec.Unmarshal(data, &s))
+	assert.Equal(t, "value", s)
+}
+
+func TestFileCacher(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := cache.NewCacher(ctx, "file", cache.Options{AdapterConfig: dir})
+	assert.NoError(t, err)
+	defer c.Close()
+	keys := NewKeyring()
+	assert.NoError(t, keys.Add(1, key(1)))
+	c.SetCodec(New(json.JSON, keys))
+
+	u := user{Name: "A", Email: "a@example.com"}
+	assert.NoError(t, c.Put(ctx, "user", u, 60))
+	var recv user
+	assert.NoError(t, c.Get(ctx, "user", &recv))
+	assert.Equal(t, u, recv)
+
+	var files int
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), u.Email)
+		files++
+		return nil
+	})
+	assert.Equal(t, 1, files)
+}
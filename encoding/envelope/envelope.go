@@ -0,0 +1,164 @@
+// Package envelope wraps the payloads of a codec in a header naming the
+// codec, so that the codec of a cache can change without losing the
+// entries written before.
+//
+// The header is made of two magic bytes, the ID the codec is registered
+// under in the encoding package, a byte of flags, a big-endian schema
+// version of two bytes and a checksum of the header of two bytes. A codec
+// migration, e.g. from JSON to gob, takes
+// two deployments: the first writes enveloped JSON and reads the entries
+// without a header as JSON,
+//
+//	c.SetCodec(envelope.New(json.JSON).WithFallback(json.JSON))
+//
+// and once every instance runs it, the second writes gob while still
+// reading the JSON entries:
+//
+//	c.SetCodec(envelope.New(gob.GOB).WithFallback(json.JSON))
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/admpub/cache/encoding"
+	// The built-in codecs are always decodable.
+	_ "github.com/admpub/cache/encoding/gob"
+	_ "github.com/admpub/cache/encoding/json"
+)
+
+// Magic starts every envelope. Neither JSON nor gob payloads start with
+// its first byte, but binary payloads may, e.g. a MessagePack float32 or a
+// tagged CBOR value, hence the checksum ending the header.
+var Magic = [2]byte{0xCA, 0xC4}
+
+// HeaderSize is the size of the envelope header.
+const HeaderSize = 8
+
+// checksum returns the checksum of the header fields, the 16 low bits of
+// their CRC-32.
+func checksum(b []byte) uint16 {
+	return uint16(crc32.ChecksumIEEE(b[:HeaderSize-2]))
+}
+
+// ErrSchemaVersion is returned for the entries written with a schema
+// version older than the minimum one, which callers usually treat as a
+// cache miss.
+var ErrSchemaVersion = errors.New("cache/envelope: outdated schema version")
+
+// Header describes an enveloped payload.
+type Header struct {
+	Codec         uint8
+	Flags         uint8
+	SchemaVersion uint16
+}
+
+func (h Header) append(b []byte) []byte {
+	n := len(b)
+	b = append(b, Magic[0], Magic[1], h.Codec, h.Flags)
+	b = binary.BigEndian.AppendUint16(b, h.SchemaVersion)
+	return binary.BigEndian.AppendUint16(b, checksum(b[n:]))
+}
+
+// Enveloped reports whether data starts with an envelope header: the magic
+// bytes followed by fields matching their checksum. A payload of another
+// codec is taken for an envelope once in 65536 at most, and only if it
+// starts with the magic bytes.
+func Enveloped(data []byte) bool {
+	return len(data) >= HeaderSize && data[0] == Magic[0] && data[1] == Magic[1] &&
+		binary.BigEndian.Uint16(data[HeaderSize-2:HeaderSize]) == checksum(data)
+}
+
+// Decode returns the header of an enveloped payload and the payload of the
+// codec it names.
+func Decode(data []byte) (Header, []byte, error) {
+	if !Enveloped(data) {
+		return Header{}, nil, errors.New("cache/envelope: no envelope header")
+	}
+	h := Header{
+		Codec:         data[2],
+		Flags:         data[3],
+		SchemaVersion: binary.BigEndian.Uint16(data[4:6]),
+	}
+	return h, data[HeaderSize:], nil
+}
+
+// Codec writes the payloads of a registered codec in envelopes, and reads
+// the envelopes of every registered codec.
+type Codec struct {
+	codec     encoding.Codec
+	header    Header
+	fallback  encoding.Codec
+	minSchema uint16
+}
+
+var _ encoding.Codec = (*Codec)(nil)
+
+// New returns a codec enveloping the payloads of codec, which must be
+// registered with encoding.Register. The payloads without an envelope are
+// decoded with codec too, unless WithFallback names another one.
+func New(codec encoding.Codec) *Codec {
+	id, ok := encoding.IDOf(codec)
+	if !ok {
+		panic(fmt.Sprintf("cache/envelope: codec %T is not registered", codec))
+	}
+	return &Codec{codec: codec, header: Header{Codec: id}, fallback: codec}
+}
+
+// WithFallback sets the codec decoding the payloads without an envelope,
+// written before the envelopes were introduced. The payloads of binary
+// codecs such as MessagePack or CBOR may start with the magic bytes, and
+// are told apart from the envelopes by the checksum of the header.
+func (c *Codec) WithFallback(codec encoding.Codec) *Codec {
+	c.fallback = codec
+	return c
+}
+
+// WithSchema sets the schema version written in the envelopes, and the
+// minimum version of the envelopes read, from which older entries make
+// Unmarshal fail with ErrSchemaVersion. Payloads without an envelope have
+// version 0.
+func (c *Codec) WithSchema(version uint16, minVersion uint16) *Codec {
+	c.header.SchemaVersion = version
+	c.minSchema = minVersion
+	return c
+}
+
+// WithFlags sets the flags written in the envelopes, which are left to the
+// application.
+func (c *Codec) WithFlags(flags uint8) *Codec {
+	c.header.Flags = flags
+	return c
+}
+
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, HeaderSize+len(data))
+	return append(c.header.append(b), data...), nil
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	if !Enveloped(data) {
+		if len(data) > 0 && c.minSchema > 0 {
+			return ErrSchemaVersion
+		}
+		return c.fallback.Unmarshal(data, v)
+	}
+	h, payload, err := Decode(data)
+	if err != nil {
+		return err
+	}
+	if h.SchemaVersion < c.minSchema {
+		return ErrSchemaVersion
+	}
+	codec, ok := encoding.Lookup(h.Codec)
+	if !ok {
+		return fmt.Errorf("cache/envelope: unknown codec %d", h.Codec)
+	}
+	return codec.Unmarshal(payload, v)
+}
@@ -0,0 +1,126 @@
+package envelope
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/encoding/gob"
+	"github.com/admpub/cache/encoding/json"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func TestCodec(t *testing.T) {
+	u := user{Name: "A", Age: 7}
+	data, err := New(gob.GOB).WithFlags(0x80).WithSchema(3, 0).Marshal(u)
+	assert.NoError(t, err)
+	assert.True(t, Enveloped(data))
+	h, payload, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, Header{Codec: encoding.IDGOB, Flags: 0x80, SchemaVersion: 3}, h)
+	var recv user
+	assert.NoError(t, gob.GOB.Unmarshal(payload, &recv))
+	assert.Equal(t, u, recv)
+
+	// A JSON codec reads the gob envelopes.
+	recv = user{}
+	assert.NoError(t, New(json.JSON).Unmarshal(data, &recv))
+	assert.Equal(t, u, recv)
+
+	_, _, err = Decode([]byte(`{"Name":"A"}`))
+	assert.Error(t, err)
+	unknown := Header{Codec: 99}.append(nil)
+	assert.EqualError(t, New(json.JSON).Unmarshal(unknown, &recv), "cache/envelope: unknown codec 99")
+	assert.Panics(t, func() { New(struct{ encoding.Codec }{json.JSON}) })
+}
+
+// rawCodec decodes payloads into a *[]byte as they are.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = data
+	return nil
+}
+
+func TestBinaryFallback(t *testing.T) {
+	// A binary payload starting with the magic bytes, as a CBOR value with
+	// tags 10 and 4 does, is not an envelope.
+	payload := []byte{Magic[0], Magic[1], encoding.IDJSON, 0x82, 0x21, 0x19, 0x6a, 0xb3}
+	assert.False(t, Enveloped(payload))
+	var recv []byte
+	assert.NoError(t, New(json.JSON).WithFallback(rawCodec{}).Unmarshal(payload, &recv))
+	assert.Equal(t, payload, recv)
+
+	data, err := New(json.JSON).Marshal("value")
+	assert.NoError(t, err)
+	assert.True(t, Enveloped(data))
+	data[3] ^= 1
+	assert.False(t, Enveloped(data), "altered header")
+}
+
+func TestSchemaVersion(t *testing.T) {
+	v1, err := New(json.JSON).WithSchema(1, 0).Marshal(user{Name: "A"})
+	assert.NoError(t, err)
+	legacy, err := json.JSON.Marshal(user{Name: "A"})
+	assert.NoError(t, err)
+
+	codec := New(json.JSON).WithSchema(2, 2)
+	var recv user
+	assert.Equal(t, ErrSchemaVersion, codec.Unmarshal(v1, &recv))
+	assert.Equal(t, ErrSchemaVersion, codec.Unmarshal(legacy, &recv))
+	v2, err := codec.Marshal(user{Name: "B"})
+	assert.NoError(t, err)
+	assert.NoError(t, codec.Unmarshal(v2, &recv))
+	assert.Equal(t, "B", recv.Name)
+}
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewCacher(ctx, "file", cache.Options{AdapterConfig: t.TempDir()})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// Entries written before the envelopes.
+	c.SetCodec(json.JSON)
+	assert.NoError(t, c.Put(ctx, "legacy", user{Name: "A", Age: 1}, 0))
+
+	// Enveloped JSON.
+	c.SetCodec(New(json.JSON).WithFallback(json.JSON))
+	assert.NoError(t, c.Put(ctx, "json", user{Name: "B", Age: 2}, 0))
+
+	// Enveloped gob, reading every entry.
+	c.SetCodec(New(gob.GOB).WithFallback(json.JSON))
+	assert.NoError(t, c.Put(ctx, "gob", user{Name: "C", Age: 3}, 0))
+	for key, want := range map[string]user{"legacy": {"A", 1}, "json": {"B", 2}, "gob": {"C", 3}} {
+		var recv user
+		assert.NoError(t, c.Get(ctx, key, &recv), key)
+		assert.Equal(t, want, recv)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	codec, ok := encoding.ByName("gob")
+	assert.True(t, ok)
+	assert.Equal(t, gob.GOB, codec)
+	codec, ok = encoding.Lookup(encoding.IDJSON)
+	assert.True(t, ok)
+	assert.Equal(t, json.JSON, codec)
+	_, ok = encoding.IDOf(struct{ encoding.Codec }{json.JSON})
+	assert.False(t, ok)
+
+	assert.Panics(t, func() { encoding.Register(encoding.IDJSON, "json2", gob.GOB) })
+	assert.Panics(t, func() { encoding.Register(200, "gob", json.JSON) })
+	assert.Panics(t, func() { encoding.Register(0, "none", json.JSON) })
+	assert.NotPanics(t, func() { encoding.Register(encoding.IDJSON, "json", json.JSON) })
+}
@@ -23,3 +23,7 @@ func (_ *gobx) Unmarshal(data []byte, v interface{}) error {
 	buf := bytes.NewBuffer(data)
 	return gob.NewDecoder(buf).Decode(v)
 }
+
+func init() {
+	encoding.Register(encoding.IDGOB, "gob", GOB)
+}
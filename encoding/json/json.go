@@ -1,6 +1,8 @@
 package json
 
 import (
+	"bytes"
+
 	"github.com/admpub/cache/encoding"
 	"github.com/webx-top/com/encoding/json"
 )
@@ -8,13 +10,29 @@ import (
 // JSON default JSON codec
 var JSON encoding.Codec = &jsonx{}
 
+// JSONUseNumber is the JSON codec decoding the numbers stored in
+// interface{} values as json.Number rather than float64, so that integers
+// keep their precision and can be told from floats.
+var JSONUseNumber encoding.Codec = &jsonx{useNumber: true}
+
 type jsonx struct {
+	useNumber bool
 }
 
 func (_ *jsonx) Marshal(v interface{}) ([]byte, error) {
 	return json.Marshal(v)
 }
 
-func (_ *jsonx) Unmarshal(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+func (j *jsonx) Unmarshal(data []byte, v interface{}) error {
+	if !j.useNumber {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func init() {
+	encoding.Register(encoding.IDJSON, "json", JSON)
+	encoding.Register(encoding.IDJSONUseNumber, "json-number", JSONUseNumber)
 }
@@ -0,0 +1,78 @@
+package msgpack
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// MsgPack default MessagePack codec. Struct fields are named by their
+// msgpack tag, else by their json tag, else by their name. Integers are
+// encoded in their most compact form, and decoded into an interface{} as
+// int64 or uint64.
+var MsgPack encoding.Codec = &msgpackx{}
+
+func init() {
+	encoding.Register(encoding.IDMsgPack, "msgpack", MsgPack)
+}
+
+type msgpackx struct {
+}
+
+type encoder struct {
+	buf bytes.Buffer
+	enc *msgpack.Encoder
+}
+
+type decoder struct {
+	r   bytes.Reader
+	dec *msgpack.Decoder
+}
+
+var encoders = sync.Pool{New: func() interface{} {
+	e := &encoder{}
+	e.enc = msgpack.NewEncoder(&e.buf)
+	e.enc.SetCustomStructTag("json")
+	e.enc.UseCompactInts(true)
+	return e
+}}
+
+var decoders = sync.Pool{New: func() interface{} {
+	d := &decoder{}
+	d.dec = msgpack.NewDecoder(&d.r)
+	d.dec.SetCustomStructTag("json")
+	d.dec.UseLooseInterfaceDecoding(true)
+	return d
+}}
+
+// maxPooledSize bounds the buffers kept in the pool, so that a large value
+// does not pin its buffer.
+const maxPooledSize = 64 * 1024
+
+func (_ *msgpackx) Marshal(v interface{}) ([]byte, error) {
+	e := encoders.Get().(*encoder)
+	e.buf.Reset()
+	e.enc.ResetWriter(&e.buf)
+	err := e.enc.Encode(v)
+	var data []byte
+	if err == nil {
+		data = bytes.Clone(e.buf.Bytes())
+	}
+	if e.buf.Cap() <= maxPooledSize {
+		encoders.Put(e)
+	}
+	return data, err
+}
+
+func (_ *msgpackx) Unmarshal(data []byte, v interface{}) error {
+	d := decoders.Get().(*decoder)
+	d.r.Reset(data)
+	d.dec.ResetReader(&d.r)
+	err := d.dec.Decode(v)
+	d.r.Reset(nil)
+	decoders.Put(d)
+	return err
+}
@@ -0,0 +1,79 @@
+package msgpack
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type session struct {
+	ID      string            `msgpack:"id"`
+	UserID  int64             `json:"uid"`
+	Roles   []string          `msgpack:"roles,omitempty"`
+	Data    map[string]string `msgpack:"data"`
+	Expires time.Time         `msgpack:"exp"`
+	Secret  string            `msgpack:"-"`
+}
+
+func TestCodec(t *testing.T) {
+	s := session{
+		ID:      "abc",
+		UserID:  1 << 40,
+		Data:    map[string]string{"k": "v"},
+		Expires: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		Secret:  "secret",
+	}
+	data, err := MsgPack.Marshal(s)
+	assert.NoError(t, err)
+	var fields map[string]interface{}
+	assert.NoError(t, msgpack.Unmarshal(data, &fields))
+	assert.Contains(t, fields, "id")
+	assert.Contains(t, fields, "uid", "json tags are the fallback")
+	assert.NotContains(t, fields, "roles")
+	assert.NotContains(t, fields, "Secret")
+
+	var recv session
+	assert.NoError(t, MsgPack.Unmarshal(data, &recv))
+	assert.True(t, s.Expires.Equal(recv.Expires), "times are decoded in the local zone")
+	s.Secret, recv.Expires = "", s.Expires
+	assert.Equal(t, s, recv)
+
+	var v interface{}
+	assert.NoError(t, MsgPack.Unmarshal(data, &v))
+	assert.Equal(t, "abc", v.(map[string]interface{})["id"])
+	v = nil
+	assert.NoError(t, MsgPack.Unmarshal(mustMarshal(t, int64(-3)), &v))
+	assert.Equal(t, int64(-3), v)
+
+	assert.Error(t, MsgPack.Unmarshal([]byte{0xc1}, &v))
+	_, err = MsgPack.Marshal(make(chan int))
+	assert.Error(t, err)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := MsgPack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestConcurrency(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				in := session{ID: "s", UserID: int64(i*1000 + j)}
+				var out session
+				assert.NoError(t, MsgPack.Unmarshal(mustMarshal(t, in), &out))
+				assert.Equal(t, in.UserID, out.UserID)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
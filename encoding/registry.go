@@ -0,0 +1,86 @@
+package encoding
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Codec IDs of the codecs of this module. The IDs from 128 on are left to
+// the codecs registered by applications.
+const (
+	IDJSON          uint8 = 1
+	IDGOB           uint8 = 2
+	IDJSONUseNumber uint8 = 3
+	IDTyped         uint8 = 4
+	IDMsgPack       uint8 = 5
+	IDCBOR          uint8 = 6
+)
+
+type registration struct {
+	id    uint8
+	name  string
+	codec Codec
+}
+
+var registry = struct {
+	sync.RWMutex
+	byID    map[uint8]*registration
+	byName  map[string]*registration
+	byCodec map[Codec]*registration
+}{
+	byID:    map[uint8]*registration{},
+	byName:  map[string]*registration{},
+	byCodec: map[Codec]*registration{},
+}
+
+// Register makes codec known under id and name, so that payloads naming
+// their codec can be decoded. The codec must be comparable, e.g. a
+// pointer. It panics if id or name is taken by another codec, or if id
+// is 0.
+func Register(id uint8, name string, codec Codec) {
+	if id == 0 {
+		panic("cache/encoding: codec ID 0 is reserved")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if r, ok := registry.byID[id]; ok && r.codec != codec {
+		panic(fmt.Sprintf("cache/encoding: codec ID %d is already registered as %s", id, r.name))
+	}
+	if r, ok := registry.byName[name]; ok && r.codec != codec {
+		panic(fmt.Sprintf("cache/encoding: codec name %s is already registered with ID %d", name, r.id))
+	}
+	r := &registration{id: id, name: name, codec: codec}
+	registry.byID[id] = r
+	registry.byName[name] = r
+	registry.byCodec[codec] = r
+}
+
+// Lookup returns the codec registered under id.
+func Lookup(id uint8) (Codec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if r, ok := registry.byID[id]; ok {
+		return r.codec, true
+	}
+	return nil, false
+}
+
+// ByName returns the codec registered under name, e.g. json or gob.
+func ByName(name string) (Codec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if r, ok := registry.byName[name]; ok {
+		return r.codec, true
+	}
+	return nil, false
+}
+
+// IDOf returns the ID codec is registered under.
+func IDOf(codec Codec) (uint8, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if r, ok := registry.byCodec[codec]; ok {
+		return r.id, true
+	}
+	return 0, false
+}
@@ -0,0 +1,101 @@
+package typed
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webx-top/echo/param"
+)
+
+var types = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	names  map[reflect.Type]string
+}{
+	byName: map[string]reflect.Type{},
+	names:  map[reflect.Type]string{},
+}
+
+// Register records the type of value, under its package path and name,
+// so that the values of this type decoded into an interface{} get it
+// back, as gob.Register does. Registering a type covers the pointers to
+// it.
+func Register(value interface{}) {
+	rt := reflect.TypeOf(value)
+	RegisterName(defaultName(rt), value)
+}
+
+// RegisterName is like Register but uses name for the type, which keeps
+// the stored values readable when the type is renamed or moved. It panics
+// if name or the type is registered differently.
+func RegisterName(name string, value interface{}) {
+	rt := reflect.TypeOf(value)
+	if rt == nil || len(name) == 0 {
+		panic("cache/typed: cannot register a nil value or an empty name")
+	}
+	types.Lock()
+	defer types.Unlock()
+	if t, ok := types.byName[name]; ok && t != rt {
+		panic(fmt.Sprintf("cache/typed: name %s is already registered for %v", name, t))
+	}
+	if n, ok := types.names[rt]; ok && n != name {
+		panic(fmt.Sprintf("cache/typed: type %v is already registered as %s", rt, n))
+	}
+	types.byName[name] = rt
+	types.names[rt] = name
+}
+
+func defaultName(rt reflect.Type) string {
+	if len(rt.Name()) > 0 && len(rt.PkgPath()) > 0 {
+		return rt.PkgPath() + "." + rt.Name()
+	}
+	return rt.String()
+}
+
+// typeName returns the name values of rt are recorded under.
+func typeName(rt reflect.Type) string {
+	types.RLock()
+	name, ok := types.names[rt]
+	types.RUnlock()
+	if ok {
+		return name
+	}
+	if rt.Kind() == reflect.Ptr {
+		return "*" + typeName(rt.Elem())
+	}
+	return defaultName(rt)
+}
+
+// lookup returns the registered type of name.
+func lookup(name string) (reflect.Type, bool) {
+	types.RLock()
+	rt, ok := types.byName[name]
+	types.RUnlock()
+	if ok {
+		return rt, true
+	}
+	if elem, found := strings.CutPrefix(name, "*"); found {
+		if rt, ok = lookup(elem); ok {
+			return reflect.PointerTo(rt), true
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "",
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		[]byte(nil), []string(nil), []int(nil), []int64(nil), []float64(nil),
+		map[string]string(nil), map[string]int(nil), map[string]int64(nil),
+		map[string]interface{}(nil), []interface{}(nil), param.Store(nil),
+		time.Time{}, time.Duration(0),
+	} {
+		Register(v)
+	}
+}
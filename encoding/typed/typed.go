@@ -0,0 +1,255 @@
+// Package typed provides a JSON codec recording the Go type of the values
+// it encodes, so that decoding into an interface{}, as GetAs.Any does,
+// returns the type which was put rather than float64 or
+// map[string]interface{}.
+//
+// The types are found in a registry, which holds the basic types and is
+// extended with Register as gob.Register is. The elements of
+// map[string]interface{} and []interface{} values, and of the named types
+// based on them such as param.Store, are typed one by one, so GetAs.Map
+// and GetAs.Slice return them with their types too.
+package typed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// JSON is the type-preserving codec. The values of unregistered types
+// decoded into an interface{} are decoded as by json.JSONUseNumber.
+var JSON encoding.Codec = &Codec{useNumber: true}
+
+func init() {
+	encoding.Register(encoding.IDTyped, "typed", JSON)
+}
+
+// Codec encodes a value as a JSON node naming its type.
+type Codec struct {
+	useNumber bool
+}
+
+var _ encoding.Codec = (*Codec)(nil)
+
+// New returns a type-preserving codec, decoding the numbers stored in
+// interface{} values of unregistered types as json.Number if useNumber is
+// true, and as float64 otherwise.
+func New(useNumber bool) *Codec {
+	return &Codec{useNumber: useNumber}
+}
+
+// Kinds of the nodes whose elements are nodes.
+const (
+	kindMap    = "map"
+	kindSlice  = "slice"
+	kindStruct = "struct"
+)
+
+// node is an encoded value: its JSON, or its elements for the dynamic maps
+// and slices, or its fields for the structs with interface{} fields, such
+// as cache.Item. T is empty for nil.
+type node struct {
+	T string           `json:"t"`
+	K string           `json:"k,omitempty"`
+	V json.RawMessage  `json:"v,omitempty"`
+	M map[string]*node `json:"m,omitempty"`
+	A []*node          `json:"a,omitempty"`
+}
+
+var emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+func isDynamicMap(rt reflect.Type) bool {
+	return rt.Kind() == reflect.Map && rt.Key().Kind() == reflect.String && rt.Elem() == emptyInterface
+}
+
+func isDynamicSlice(rt reflect.Type) bool {
+	return rt.Kind() == reflect.Slice && rt.Elem() == emptyInterface
+}
+
+// isDynamicStruct reports whether rt is a struct, or a pointer to one,
+// with an exported interface{} field, whose value would lose its type in
+// the JSON of the struct.
+func isDynamicStruct(rt reflect.Type) bool {
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < rt.NumField(); i++ {
+		if f := rt.Field(i); f.IsExported() && f.Type == emptyInterface {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Codec) encode(v interface{}) (*node, error) {
+	if v == nil {
+		return &node{}, nil
+	}
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	n := &node{T: typeName(rt)}
+	var err error
+	switch {
+	case isDynamicMap(rt) && !rv.IsNil():
+		n.K = kindMap
+		n.M = make(map[string]*node, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			if n.M[iter.Key().String()], err = c.encode(iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+	case isDynamicSlice(rt) && !rv.IsNil():
+		n.K = kindSlice
+		n.A = make([]*node, rv.Len())
+		for i := range n.A {
+			if n.A[i], err = c.encode(rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	case isDynamicStruct(rt) && (rt.Kind() != reflect.Ptr || !rv.IsNil()):
+		n.K = kindStruct
+		rv = reflect.Indirect(rv)
+		n.M = make(map[string]*node, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if n.M[f.Name], err = c.encode(rv.Field(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		n.V, err = json.Marshal(v)
+	}
+	return n, err
+}
+
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	n, err := c.encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cache/typed: Unmarshal needs a non-nil pointer")
+	}
+	n := &node{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return err
+	}
+	return c.decode(n, rv.Elem())
+}
+
+func (c *Codec) unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.useNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// decode decodes n into target, which must be settable.
+func (c *Codec) decode(n *node, target reflect.Value) error {
+	if len(n.T) == 0 {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	rt := target.Type()
+	if rt == emptyInterface {
+		// An interface{} holding a pointer is decoded into its target, as
+		// encoding/json does, e.g. the Val of a cache.Item.
+		if e := target.Elem(); e.Kind() == reflect.Ptr && !e.IsNil() {
+			return c.decode(n, e.Elem())
+		}
+		return c.decodeInterface(n, target)
+	}
+	switch {
+	case n.K == kindStruct && rt.Kind() == reflect.Ptr:
+		if target.IsNil() {
+			target.Set(reflect.New(rt.Elem()))
+		}
+		return c.decode(n, target.Elem())
+	case n.K == kindStruct && rt.Kind() == reflect.Struct:
+		for name, e := range n.M {
+			if f := target.FieldByName(name); f.IsValid() && f.CanSet() {
+				if err := c.decode(e, f); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case (n.K == kindMap || n.K == kindStruct) && rt.Kind() == reflect.Map && rt.Key().Kind() == reflect.String:
+		m := reflect.MakeMapWithSize(rt, len(n.M))
+		for key, e := range n.M {
+			ev := reflect.New(rt.Elem()).Elem()
+			if err := c.decode(e, ev); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(rt.Key()), ev)
+		}
+		target.Set(m)
+		return nil
+	case n.K == kindSlice && rt.Kind() == reflect.Slice:
+		s := reflect.MakeSlice(rt, len(n.A), len(n.A))
+		for i, e := range n.A {
+			if err := c.decode(e, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		target.Set(s)
+		return nil
+	case len(n.K) > 0:
+		// A dynamic map or slice decoded into another type, e.g. a
+		// struct, goes through its plain JSON.
+		var v interface{}
+		if err := c.decodeInterface(n, reflect.ValueOf(&v).Elem()); err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return c.unmarshal(data, target.Addr().Interface())
+	}
+	return c.unmarshal(n.V, target.Addr().Interface())
+}
+
+// decodeInterface decodes n into an interface{}, as the type it names.
+func (c *Codec) decodeInterface(n *node, target reflect.Value) error {
+	rt, ok := lookup(n.T)
+	if !ok {
+		switch n.K {
+		case kindMap, kindStruct:
+			rt = reflect.TypeOf(map[string]interface{}{})
+		case kindSlice:
+			rt = reflect.TypeOf([]interface{}{})
+		default:
+			var v interface{}
+			if err := c.unmarshal(n.V, &v); err != nil {
+				return err
+			}
+			if v != nil {
+				target.Set(reflect.ValueOf(v))
+			}
+			return nil
+		}
+	}
+	val := reflect.New(rt).Elem()
+	if err := c.decode(n, val); err != nil {
+		return err
+	}
+	target.Set(val)
+	return nil
+}
@@ -0,0 +1,190 @@
+package typed
+
+import (
+	"context"
+	"database/sql"
+	stdjson "encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/webx-top/echo/param"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding/json"
+	"github.com/admpub/cache/sqlcache"
+)
+
+type User struct {
+	Name string
+	Age  int64
+}
+
+type Point struct {
+	X, Y int
+}
+
+func init() {
+	Register(User{})
+	RegisterName("point", Point{})
+}
+
+func TestGetters(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewCacher(ctx, "file", cache.Options{AdapterConfig: t.TempDir()})
+	assert.NoError(t, err)
+	defer c.Close()
+	c.SetCodec(JSON)
+	var g cache.Getter = c
+
+	put := func(key string, value interface{}) {
+		assert.NoError(t, c.Put(ctx, key, value, 0))
+	}
+	put("string", "text")
+	assert.Equal(t, "text", g.String(ctx, "string"))
+	assert.Equal(t, "text", g.Any(ctx, "string"))
+
+	put("int", 42)
+	assert.Equal(t, 42, g.Int(ctx, "int"))
+	assert.Equal(t, 42, g.Any(ctx, "int"))
+	put("uint", uint(42))
+	assert.Equal(t, uint(42), g.Uint(ctx, "uint"))
+	assert.Equal(t, uint(42), g.Any(ctx, "uint"))
+	put("int64", int64(1)<<60+1)
+	assert.Equal(t, int64(1)<<60+1, g.Int64(ctx, "int64"))
+	assert.Equal(t, int64(1)<<60+1, g.Any(ctx, "int64"))
+	put("uint64", uint64(1)<<63+1)
+	assert.Equal(t, uint64(1)<<63+1, g.Uint64(ctx, "uint64"))
+	assert.Equal(t, uint64(1)<<63+1, g.Any(ctx, "uint64"))
+	put("int32", int32(-7))
+	assert.Equal(t, int32(-7), g.Int32(ctx, "int32"))
+	assert.Equal(t, int32(-7), g.Any(ctx, "int32"))
+	put("uint32", uint32(7))
+	assert.Equal(t, uint32(7), g.Uint32(ctx, "uint32"))
+	assert.Equal(t, uint32(7), g.Any(ctx, "uint32"))
+	put("float32", float32(1.5))
+	assert.Equal(t, float32(1.5), g.Float32(ctx, "float32"))
+	assert.Equal(t, float32(1.5), g.Any(ctx, "float32"))
+	put("float64", 2.25)
+	assert.Equal(t, 2.25, g.Float64(ctx, "float64"))
+	assert.Equal(t, 2.25, g.Any(ctx, "float64"))
+	put("bytes", []byte{0, 1, 2})
+	assert.Equal(t, []byte{0, 1, 2}, g.Bytes(ctx, "bytes"))
+	assert.Equal(t, []byte{0, 1, 2}, g.Any(ctx, "bytes"))
+
+	// Numbers read into another numeric type convert.
+	assert.Equal(t, int64(42), g.Int64(ctx, "int"))
+	assert.Equal(t, float64(7), g.Float64(ctx, "uint32"))
+
+	m := map[string]interface{}{
+		"id":    int64(9),
+		"ratio": float32(0.5),
+		"user":  User{Name: "A", Age: 3},
+		"tags":  []interface{}{"x", 1, nil},
+		"at":    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"none":  nil,
+	}
+	put("map", m)
+	assert.Equal(t, m, g.Map(ctx, "map"))
+	assert.Equal(t, m, g.Any(ctx, "map"))
+	assert.Equal(t, param.Store(m), g.Mapx(ctx, "map"))
+
+	store := param.Store{"n": uint16(3), "point": Point{X: 1, Y: 2}}
+	put("store", store)
+	assert.Equal(t, store, g.Mapx(ctx, "store"))
+	assert.Equal(t, store, g.Any(ctx, "store"))
+	assert.Equal(t, map[string]interface{}(store), g.Map(ctx, "store"))
+
+	s := []interface{}{int8(1), "two", &User{Name: "B"}, map[string]interface{}{"k": uint(1)}}
+	put("slice", s)
+	assert.Equal(t, s, g.Slice(ctx, "slice"))
+	assert.Equal(t, s, g.Any(ctx, "slice"))
+
+	put("user", User{Name: "C", Age: 5})
+	assert.Equal(t, User{Name: "C", Age: 5}, g.Any(ctx, "user"))
+	assert.Equal(t, map[string]interface{}{"Name": "C", "Age": stdjson.Number("5")}, g.Map(ctx, "user"))
+	put("pointer", &User{Name: "D"})
+	assert.Equal(t, &User{Name: "D"}, g.Any(ctx, "pointer"))
+	var u User
+	assert.NoError(t, c.Get(ctx, "pointer", &u))
+	assert.Equal(t, "D", u.Name)
+
+	put("nil", nil)
+	assert.Nil(t, g.Any(ctx, "nil"))
+	assert.Nil(t, g.Slice(ctx, "nil"))
+}
+
+// TestItemAdapter goes through sqlcache, which wraps the values in a
+// cache.Item.
+func TestItemAdapter(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := sqlcache.NewWithDB(db, sqlcache.SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+	c.SetCodec(JSON)
+	var g cache.Getter = c
+
+	assert.NoError(t, c.Put(ctx, "int64", int64(5), 0))
+	assert.Equal(t, int64(5), g.Any(ctx, "int64"))
+	assert.Equal(t, int64(5), g.Int64(ctx, "int64"))
+	m := map[string]interface{}{"n": uint8(1), "user": User{Name: "A"}}
+	assert.NoError(t, c.Put(ctx, "map", m, 0))
+	assert.Equal(t, m, g.Any(ctx, "map"))
+	assert.NoError(t, c.Put(ctx, "pointer", &User{Name: "B", Age: 2}, 0))
+	assert.Equal(t, &User{Name: "B", Age: 2}, g.Any(ctx, "pointer"))
+	var u User
+	assert.NoError(t, c.Get(ctx, "pointer", &u))
+	assert.Equal(t, User{Name: "B", Age: 2}, u)
+	assert.NoError(t, c.Put(ctx, "nil", nil, 0))
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "nil", &u))
+
+	// Structs with interface{} fields keep the types of their values.
+	item := &cache.Item{Val: int32(3), Created: 1}
+	data, err := JSON.Marshal(item)
+	assert.NoError(t, err)
+	recv := &cache.Item{}
+	assert.NoError(t, JSON.Unmarshal(data, recv))
+	assert.Equal(t, item, recv)
+}
+
+type unregistered struct {
+	N int64
+}
+
+func TestUnregistered(t *testing.T) {
+	data, err := JSON.Marshal(unregistered{N: 1 << 60})
+	assert.NoError(t, err)
+	var v interface{}
+	assert.NoError(t, JSON.Unmarshal(data, &v))
+	assert.Equal(t, map[string]interface{}{"N": stdjson.Number("1152921504606846976")}, v)
+	assert.NoError(t, New(false).Unmarshal(data, &v))
+	assert.Equal(t, map[string]interface{}{"N": float64(1 << 60)}, v)
+
+	var u unregistered
+	assert.NoError(t, JSON.Unmarshal(data, &u))
+	assert.Equal(t, unregistered{N: 1 << 60}, u)
+
+	// A dynamic map decoded into a struct.
+	data, err = JSON.Marshal(map[string]interface{}{"N": int64(3)})
+	assert.NoError(t, err)
+	assert.NoError(t, JSON.Unmarshal(data, &u))
+	assert.Equal(t, unregistered{N: 3}, u)
+
+	assert.Error(t, JSON.Unmarshal(data, u))
+	assert.Panics(t, func() { RegisterName("point", User{}) })
+	assert.Panics(t, func() { RegisterName("other", Point{}) })
+}
+
+func TestJSONUseNumber(t *testing.T) {
+	data, err := json.JSON.Marshal(map[string]interface{}{"n": int64(1)<<60 + 1})
+	assert.NoError(t, err)
+	var v map[string]interface{}
+	assert.NoError(t, json.JSONUseNumber.Unmarshal(data, &v))
+	assert.Equal(t, stdjson.Number("1152921504606846977"), v["n"])
+	assert.NoError(t, json.JSON.Unmarshal(data, &v))
+	assert.Equal(t, float64(1<<60), v["n"])
+}
@@ -6,6 +6,12 @@ var (
 	ErrNotFound     = errors.New("not found")
 	ErrExpired      = errors.New("expired")
 	ErrNotSupported = errors.New("not supported operation")
+	// ErrNotStored is returned when a conditional write such as Add or
+	// Replace does not apply.
+	ErrNotStored = errors.New("not stored")
+	// ErrCASConflict is returned by a compare-and-swap whose value was
+	// modified since it was read.
+	ErrCASConflict = errors.New("compare-and-swap conflict")
 )
 
 // IsDataStatusError reports whether the error is either ErrNotFound or ErrExpired.
@@ -21,3 +27,9 @@ func IsExpired(err error) bool { return errors.Is(err, ErrExpired) }
 
 // IsNotSupported reports whether an error indicates the operation is not supported.
 func IsNotSupported(err error) bool { return errors.Is(err, ErrNotSupported) }
+
+// IsNotStored reports whether an error is ErrNotStored.
+func IsNotStored(err error) bool { return errors.Is(err, ErrNotStored) }
+
+// IsCASConflict reports whether an error is ErrCASConflict.
+func IsCASConflict(err error) bool { return errors.Is(err, ErrCASConflict) }
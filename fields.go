@@ -0,0 +1,311 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/admpub/cache/encoding"
+)
+
+// FieldsCache is implemented by the adapters which can store a struct as a
+// hash whose fields are read and updated one by one, such as the redis
+// adapters. Fields returns one for any Cache.
+//
+// Fields are named by their `cache` struct tag, or by their Go name; a tag
+// of "-" skips the field and the fields of embedded structs are promoted.
+// Strings, numbers and booleans are stored as text, so that integers can be
+// incremented in place, and other values are encoded with the Codec.
+type FieldsCache interface {
+	// PutFields puts the fields of the struct val into cache with key and
+	// expire time, replacing the fields stored before.
+	// If expired is 0, it lives forever.
+	PutFields(ctx context.Context, key string, val interface{}, expire int64) error
+	// GetFields decodes the named fields, or all fields if none is named,
+	// into the struct pointed to by val. It returns ErrNotFound if none of
+	// them is stored.
+	GetFields(ctx context.Context, key string, val interface{}, fields ...string) error
+	// UpdateField sets a field of the cached value by given key, keeping its
+	// expiration. It returns ErrNotFound if the key does not exist.
+	UpdateField(ctx context.Context, key string, field string, val interface{}) error
+	// IncrField adds n to an integer field of the cached value by given key
+	// and returns the result. A missing field counts from 0.
+	IncrField(ctx context.Context, key string, field string, n int64) (int64, error)
+}
+
+// Fields returns c as a FieldsCache. Adapters without native support get an
+// emulation which stores the fields as a single value with Put and updates
+// them by reading the whole value, which unlike the native implementations
+// is not atomic.
+func Fields(c Cache) FieldsCache {
+	if fc, ok := c.(FieldsCache); ok {
+		return fc
+	}
+	return fieldsEmulation{c}
+}
+
+// fieldsEntry is the value stored by the emulation.
+type fieldsEntry struct {
+	Fields   map[string]string
+	Deadline int64 // unix time the entry expires at, 0 if it lives forever
+}
+
+type fieldsEmulation struct {
+	Cache
+}
+
+func (e fieldsEmulation) put(ctx context.Context, key string, entry *fieldsEntry) error {
+	var expire int64
+	if entry.Deadline > 0 {
+		if expire = entry.Deadline - time.Now().Unix(); expire <= 0 {
+			return e.Delete(ctx, key)
+		}
+	}
+	return e.Put(ctx, key, entry, expire)
+}
+
+func (e fieldsEmulation) get(ctx context.Context, key string) (*fieldsEntry, error) {
+	entry := &fieldsEntry{}
+	if err := e.Get(ctx, key, entry); err != nil {
+		if IsExpired(err) {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if entry.Deadline > 0 && entry.Deadline <= time.Now().Unix() {
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (e fieldsEmulation) PutFields(ctx context.Context, key string, val interface{}, expire int64) error {
+	fields, err := EncodeFields(e.Codec(), val)
+	if err != nil {
+		return err
+	}
+	entry := &fieldsEntry{Fields: fields}
+	if expire > 0 {
+		entry.Deadline = time.Now().Unix() + expire
+	}
+	return e.Put(ctx, key, entry, expire)
+}
+
+func (e fieldsEmulation) GetFields(ctx context.Context, key string, val interface{}, fields ...string) error {
+	entry, err := e.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		selected := make(map[string]string, len(fields))
+		for _, name := range fields {
+			if v, ok := entry.Fields[name]; ok {
+				selected[name] = v
+			}
+		}
+		if len(selected) == 0 {
+			return ErrNotFound
+		}
+		entry.Fields = selected
+	}
+	return DecodeFields(e.Codec(), entry.Fields, val)
+}
+
+func (e fieldsEmulation) UpdateField(ctx context.Context, key string, field string, val interface{}) error {
+	v, err := EncodeField(e.Codec(), val)
+	if err != nil {
+		return err
+	}
+	entry, err := e.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	entry.Fields = copyFields(entry.Fields, field, v)
+	return e.put(ctx, key, entry)
+}
+
+func (e fieldsEmulation) IncrField(ctx context.Context, key string, field string, n int64) (int64, error) {
+	entry, err := e.get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var i int64
+	if v, ok := entry.Fields[field]; ok {
+		if i, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("cache: field %s is not an integer", field)
+		}
+	}
+	i += n
+	entry.Fields = copyFields(entry.Fields, field, strconv.FormatInt(i, 10))
+	return i, e.put(ctx, key, entry)
+}
+
+// copyFields returns a copy of fields with field set to v, leaving the map
+// the adapter may still hold untouched.
+func copyFields(fields map[string]string, field string, v string) map[string]string {
+	r := make(map[string]string, len(fields)+1)
+	for k, v := range fields {
+		r[k] = v
+	}
+	r[field] = v
+	return r
+}
+
+// structField is a field stored by FieldsCache.
+type structField struct {
+	name  string
+	index []int
+}
+
+var structFieldsCache sync.Map // reflect.Type => []structField
+
+func structFields(t reflect.Type) []structField {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	fields := appendStructFields(nil, t, nil)
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+func appendStructFields(fields []structField, t reflect.Type, index []int) []structField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("cache")
+		if tag == "-" {
+			continue
+		}
+		embedded := f.Anonymous && f.Type.Kind() == reflect.Struct && len(tag) == 0
+		if !f.IsExported() && !embedded {
+			continue
+		}
+		idx := append(append([]int{}, index...), i)
+		if embedded {
+			fields = appendStructFields(fields, f.Type, idx)
+			continue
+		}
+		if len(tag) == 0 {
+			tag = f.Name
+		}
+		fields = append(fields, structField{name: tag, index: idx})
+	}
+	return fields
+}
+
+func structValue(val interface{}, settable bool) (reflect.Value, error) {
+	v := reflect.ValueOf(val)
+	if settable {
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return v, errors.New("cache: fields are decoded into a non-nil struct pointer")
+		}
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return v, fmt.Errorf("cache: fields of a %s", v.Kind())
+	}
+	return v, nil
+}
+
+// EncodeFields returns the hash fields of the struct val, as described by
+// FieldsCache, encoding the values which are not text with codec.
+func EncodeFields(codec encoding.Codec, val interface{}) (map[string]string, error) {
+	v, err := structValue(val, false)
+	if err != nil {
+		return nil, err
+	}
+	fields := structFields(v.Type())
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("cache: %s has no fields to store", v.Type())
+	}
+	r := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if r[f.name], err = encodeField(codec, v.FieldByIndex(f.index)); err != nil {
+			return nil, fmt.Errorf("cache: encoding field %s: %w", f.name, err)
+		}
+	}
+	return r, nil
+}
+
+// EncodeField returns the hash field value of val. A nil val is encoded
+// as the null of codec, which decodes into the zero value of pointers,
+// maps and slices.
+func EncodeField(codec encoding.Codec, val interface{}) (string, error) {
+	return encodeField(codec, reflect.ValueOf(val))
+}
+
+func encodeField(codec encoding.Codec, v reflect.Value) (string, error) {
+	if !v.IsValid() {
+		b, err := codec.Marshal(nil)
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+	b, err := codec.Marshal(v.Interface())
+	return string(b), err
+}
+
+// DecodeFields decodes the hash fields into the struct pointed to by val.
+// Fields which val does not have are ignored.
+func DecodeFields(codec encoding.Codec, fields map[string]string, val interface{}) error {
+	v, err := structValue(val, true)
+	if err != nil {
+		return err
+	}
+	for _, f := range structFields(v.Type()) {
+		s, ok := fields[f.name]
+		if !ok {
+			continue
+		}
+		if err = decodeField(codec, s, v.FieldByIndex(f.index)); err != nil {
+			return fmt.Errorf("cache: decoding field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func decodeField(codec encoding.Codec, s string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		v.SetBool(b)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		v.SetInt(i)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		v.SetUint(i)
+		return err
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		v.SetFloat(f)
+		return err
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(s))
+			return nil
+		}
+	}
+	return codec.Unmarshal([]byte(s), v.Addr().Interface())
+}
@@ -0,0 +1,129 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type Audit struct {
+	Created int64 `cache:"created"`
+}
+
+type Profile struct {
+	Audit
+	Name    string   `cache:"name"`
+	Visits  int64    `cache:"visits"`
+	Score   float64  `cache:"score"`
+	Active  bool     `cache:"active"`
+	Tags    []string `cache:"tags"`
+	Avatar  []byte   `cache:"avatar"`
+	Address *User    `cache:"address"`
+	Token   string   `cache:"-"`
+	Comment string
+	hidden  string
+}
+
+func TestEncodeFields(t *testing.T) {
+	p := &Profile{
+		Audit:   Audit{Created: 1700000000},
+		Name:    "A",
+		Visits:  3,
+		Score:   1.5,
+		Active:  true,
+		Tags:    []string{"x", "y"},
+		Avatar:  []byte{0xff, 0x00},
+		Address: &User{Name: "B", Age: 7},
+		Token:   "secret",
+		Comment: "c",
+		hidden:  "h",
+	}
+	fields, err := cache.EncodeFields(json.JSON, p)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"created": "1700000000",
+		"name":    "A",
+		"visits":  "3",
+		"score":   "1.5",
+		"active":  "true",
+		"tags":    `["x","y"]`,
+		"avatar":  "\xff\x00",
+		"address": `{"Name":"B","Age":7}`,
+		"Comment": "c",
+	}, fields)
+
+	recv := &Profile{}
+	assert.NoError(t, cache.DecodeFields(json.JSON, fields, recv))
+	p.Token, p.hidden = "", ""
+	assert.Equal(t, p, recv)
+
+	assert.Error(t, cache.DecodeFields(json.JSON, map[string]string{"visits": "many"}, recv))
+	assert.Error(t, cache.DecodeFields(json.JSON, fields, Profile{}), "not a pointer")
+	_, err = cache.EncodeFields(json.JSON, "text")
+	assert.Error(t, err)
+}
+
+// testFields checks the FieldsCache behaviour expected of every adapter.
+func testFields(t *testing.T, c cache.FieldsCache) {
+	ctx := context.Background()
+	p := &Profile{Name: "A", Visits: 1, Tags: []string{"x"}, Avatar: []byte("a"), Address: &User{Name: "B", Age: 7}}
+	assert.NoError(t, c.PutFields(ctx, "profile", p, 3600))
+
+	recv := &Profile{}
+	assert.NoError(t, c.GetFields(ctx, "profile", recv))
+	assert.Equal(t, p, recv)
+
+	assert.NoError(t, c.UpdateField(ctx, "profile", "name", "C"))
+	assert.NoError(t, c.UpdateField(ctx, "profile", "address", &User{Name: "D", Age: 8}))
+	visits, err := c.IncrField(ctx, "profile", "visits", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), visits)
+	visits, err = c.IncrField(ctx, "profile", "missing", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), visits)
+
+	part := &Profile{}
+	assert.NoError(t, c.GetFields(ctx, "profile", part, "name", "visits", "address"))
+	assert.Equal(t, &Profile{Name: "C", Visits: 3, Address: &User{Name: "D", Age: 8}}, part)
+
+	// A nil value clears the field.
+	assert.NoError(t, c.UpdateField(ctx, "profile", "address", nil))
+	assert.NoError(t, c.GetFields(ctx, "profile", part, "address"))
+	assert.Nil(t, part.Address)
+
+	assert.Equal(t, cache.ErrNotFound, c.GetFields(ctx, "profile", part, "unknown"))
+	assert.Equal(t, cache.ErrNotFound, c.GetFields(ctx, "missing", part))
+	assert.Equal(t, cache.ErrNotFound, c.UpdateField(ctx, "missing", "name", "E"))
+	_, err = c.IncrField(ctx, "missing", "visits", 1)
+	assert.Equal(t, cache.ErrNotFound, err)
+	_, err = c.IncrField(ctx, "profile", "name", 1)
+	assert.Error(t, err)
+
+	// PutFields replaces every field.
+	assert.NoError(t, c.PutFields(ctx, "profile", &Profile{Name: "F"}, 0))
+	recv = &Profile{}
+	assert.NoError(t, c.GetFields(ctx, "profile", recv, "visits", "name"))
+	assert.Equal(t, &Profile{Name: "F"}, recv)
+}
+
+func TestFieldsEmulation(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewCacher(ctx, "memory", cache.Options{Interval: 300})
+	assert.NoError(t, err)
+	defer c.Close()
+	_, native := c.(cache.FieldsCache)
+	assert.False(t, native)
+	testFields(t, cache.Fields(c))
+
+	// Updates keep the expiration.
+	fc := cache.Fields(c)
+	assert.NoError(t, fc.PutFields(ctx, "short", &Profile{Name: "A"}, 1))
+	assert.NoError(t, fc.UpdateField(ctx, "short", "name", "B"))
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, cache.ErrNotFound, fc.GetFields(ctx, "short", &Profile{}))
+	assert.Equal(t, cache.ErrNotFound, fc.UpdateField(ctx, "short", "name", "C"))
+}
@@ -16,18 +16,21 @@ package cache
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/webx-top/com"
 
 	"github.com/admpub/cache/encoding"
+	"github.com/admpub/ini"
 )
 
 var cacheItemPool = sync.Pool{
@@ -57,24 +60,57 @@ func (item *Item) hasExpired() bool {
 		(time.Now().Unix()-item.Created) >= item.Expire
 }
 
+// itemMeta decodes the timestamps of an encoded Item without its value.
+type itemMeta struct {
+	Created int64
+	Expire  int64
+}
+
 func (item *Item) Reset() {
 	item.Val = nil
 	item.Created = 0
 	item.Expire = 0
 }
 
+const (
+	fileLockSuffix = ".lock"
+	fileTempSuffix = ".tmp"
+
+	// fileKeyLockStripes is the number of in-process mutexes shared by all keys.
+	fileKeyLockStripes = 64
+
+	// staleTempFileAge is the age after which GC removes temporary files
+	// left behind by a writer that crashed before renaming them.
+	staleTempFileAge = 10 * time.Minute
+)
+
+var fileTempSeq uint64
+
 // FileCacher represents a file cache adapter implementation.
+//
+// Entries are written to a temporary file, synced and renamed into place, so
+// readers never observe a partially written entry. Operations that modify an
+// entry hold an exclusive advisory lock on a sibling ".lock" file, which
+// serialises them across goroutines and, where flock is available, across
+// processes sharing the same root path.
 type FileCacher struct {
 	GetAs
 	codec    encoding.Codec
 	lock     sync.RWMutex
+	keyLocks [fileKeyLockStripes]sync.Mutex
 	rootPath string
 	interval int // GC interval.
+	maxBytes int64
+	maxFiles int64
+	index    *fileIndex // nil when no quota is configured.
+	layout   fileLayout
+
+	mmapMinSize int64 // 0 disables mapping in GetBytes and GetReader.
 }
 
 // NewFileCacher creates and returns a new file cacher.
 func NewFileCacher() *FileCacher {
-	c := &FileCacher{codec: DefaultCodec}
+	c := &FileCacher{codec: DefaultCodec, layout: defaultFileLayout()}
 	c.GetAs = GetAs{Cache: c}
 	return c
 }
@@ -88,34 +124,184 @@ func (c *FileCacher) Codec() encoding.Codec {
 }
 
 func (c *FileCacher) filepath(key string) string {
-	m := md5.Sum([]byte(key))
-	hash := hex.EncodeToString(m[:])
-	return filepath.Join(c.rootPath, string(hash[0]), string(hash[1]), hash)
+	return c.layout.path(c.rootPath, key)
+}
+
+// acquire takes the exclusive lock guarding the entry stored at filename.
+// The lock file is checked again after locking: a concurrent holder may have
+// removed it on release, in which case the lock is taken on a fresh file.
+func (c *FileCacher) acquire(filename string) (*os.File, error) {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	mu := &c.keyLocks[h.Sum32()%fileKeyLockStripes]
+	mu.Lock()
+
+	name := filename + fileLockSuffix
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, c.layout.fileMode)
+		if err != nil {
+			if os.IsNotExist(err) {
+				if err = os.MkdirAll(filepath.Dir(name), c.layout.dirMode); err == nil {
+					continue
+				}
+			}
+			mu.Unlock()
+			return nil, err
+		}
+		if err = flock(f); err != nil {
+			f.Close()
+			mu.Unlock()
+			return nil, fmt.Errorf("flock: %w", err)
+		}
+		locked, err := f.Stat()
+		if err == nil {
+			var current os.FileInfo
+			current, err = os.Stat(name)
+			if err == nil && os.SameFile(locked, current) {
+				return f, nil
+			}
+		}
+		funlock(f)
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			mu.Unlock()
+			return nil, err
+		}
+	}
+}
+
+// release removes the lock file and drops the lock taken by acquire.
+func (c *FileCacher) release(filename string, f *os.File) {
+	os.Remove(f.Name())
+	funlock(f)
+	f.Close()
+
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	c.keyLocks[h.Sum32()%fileKeyLockStripes].Unlock()
+}
+
+// write atomically replaces filename with data.
+func (c *FileCacher) write(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, c.layout.dirMode); err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.%d%s", filename, os.Getpid(), atomic.AddUint64(&fileTempSeq, 1), fileTempSuffix)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, c.layout.fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes the directory entry of a renamed file. Not every platform
+// supports syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func (c *FileCacher) put(filename string, key string, val interface{}, created, expire int64) error {
+	payload, err := c.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	h := &fileHeader{
+		Version: fileFormatVersion,
+		Codec:   fileCodecID(c.codec),
+		Created: created,
+		Expire:  expire,
+		Key:     key,
+	}
+	data := h.encode(payload)
+	if err = c.write(filename, data); err != nil {
+		return err
+	}
+	if c.index != nil {
+		c.index.set(filename, int64(len(data)))
+	}
+	return nil
+}
+
+// remove deletes filename, which must be locked by the caller.
+func (c *FileCacher) remove(filename string) error {
+	err := os.Remove(filename)
+	if c.index != nil && (err == nil || os.IsNotExist(err)) {
+		c.index.remove(filename)
+	}
+	return err
 }
 
 // Put puts value into cache with key and expire time.
 // If expired is 0, it will be deleted by next GC operation.
+// When a quota is configured, the least recently used files are evicted
+// once the write pushes the usage over it.
 func (c *FileCacher) Put(ctx context.Context, key string, val interface{}, expire int64) error {
 	filename := c.filepath(key)
-
-	item := CacheItemPoolGet()
-	item.Val = val
-	item.Created = time.Now().Unix()
-	item.Expire = expire
-
-	data, err := c.codec.Marshal(item)
-	CacheItemPoolRelease(item)
+	f, err := c.acquire(filename)
+	if err != nil {
+		return err
+	}
+	err = c.put(filename, key, val, time.Now().Unix(), expire)
+	c.release(filename, f)
 	if err != nil {
 		return err
 	}
+	return c.evict(filename)
+}
 
-	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
-	return os.WriteFile(filename, data, os.ModePerm)
+// evict removes the least recently used files until the usage fits within
+// the quota again. keep is the file that has just been written.
+func (c *FileCacher) evict(keep string) error {
+	if c.index == nil {
+		return nil
+	}
+	for _, filename := range c.index.victims(c.maxBytes, c.maxFiles, keep) {
+		f, err := c.acquire(filename)
+		if err != nil {
+			return err
+		}
+		err = c.remove(filename)
+		c.release(filename, f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *FileCacher) read(key string, value interface{}) (*Item, error) {
-	filename := c.filepath(key)
+// Usage returns the number of bytes and files accounted against the quota.
+// It is only tracked when max_bytes or max_files is configured.
+func (c *FileCacher) Usage() (bytes int64, files int64) {
+	if c.index == nil {
+		return 0, 0
+	}
+	return c.index.usage()
+}
 
+// readFile decodes the entry stored at filename into value. The value is
+// decoded even when the entry has expired, so callers can serve stale data.
+func (c *FileCacher) readFile(filename string, value interface{}) (*fileHeader, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -124,83 +310,176 @@ func (c *FileCacher) read(key string, value interface{}) (*Item, error) {
 		return nil, err
 	}
 
-	item := CacheItemPoolGet()
-	item.Val = value
+	h, offset, err := decodeFileHeader(data)
+	switch err {
+	case nil:
+		return h, c.codecByID(h.Codec).Unmarshal(data[offset:], value)
+	case errFileLegacy:
+		item := CacheItemPoolGet()
+		defer CacheItemPoolRelease(item)
+		item.Val = value
+		if err = c.codec.Unmarshal(data, item); err != nil {
+			return nil, err
+		}
+		if item.Val == nil {
+			return nil, ErrNotFound
+		}
+		return &fileHeader{Created: item.Created, Expire: item.Expire}, nil
+	default:
+		return nil, err
+	}
+}
 
-	return item, c.codec.Unmarshal(data, item)
+// header returns the header of the entry stored at filename. Entries in the
+// legacy format have no header and are decoded in full instead.
+func (c *FileCacher) header(filename string) (*fileHeader, error) {
+	h, err := readFileHeader(filename)
+	if err != errFileLegacy {
+		return h, err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	meta := &itemMeta{}
+	if err = c.codec.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("%w: %v", errFileLegacy, err)
+	}
+	return &fileHeader{Created: meta.Created, Expire: meta.Expire}, nil
+}
+
+// removeExpired deletes filename if it still holds an expired entry once the
+// entry lock is held, so that a value written concurrently is never lost.
+func (c *FileCacher) removeExpired(filename string) error {
+	f, err := c.acquire(filename)
+	if err != nil {
+		return err
+	}
+	defer c.release(filename, f)
+
+	h, err := c.header(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !h.hasExpired() {
+		return nil
+	}
+	if err = c.remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// owns reports whether the entry described by h was written for key. Two
+// keys whose digests collide share a file; the collision is logged and the
+// entry is treated as missing for the key that did not write it.
+func (c *FileCacher) owns(h *fileHeader, key string, filename string) bool {
+	if len(h.Key) == 0 { // legacy entries do not record their key
+		return true
+	}
+	if len(key) > fileHeaderMaxKeySize {
+		key = key[:fileHeaderMaxKeySize]
+	}
+	if h.Key == key {
+		return true
+	}
+	log.Printf("cache/file: key %q collides with %q stored in %s", key, h.Key, filename)
+	return false
 }
 
 // Get gets cached value by given key.
 func (c *FileCacher) Get(ctx context.Context, key string, value interface{}) error {
-	item, err := c.read(key, value)
-	if item != nil {
-		defer CacheItemPoolRelease(item)
-	}
+	filename := c.filepath(key)
+	h, err := c.readFile(filename, value)
 	if err != nil {
 		return err
 	}
-	if item.Val == nil {
+	if !c.owns(h, key, filename) {
 		return ErrNotFound
 	}
 
-	if item.hasExpired() {
-		os.Remove(c.filepath(key))
+	if h.hasExpired() {
+		c.removeExpired(filename)
 		return ErrExpired
 	}
+	if c.index != nil {
+		c.index.touch(filename)
+	}
 	return nil
 }
 
 // Delete deletes cached value by given key.
 func (c *FileCacher) Delete(ctx context.Context, key string) error {
-	return os.Remove(c.filepath(key))
-}
-
-// Incr increases cached int-type value by given key as a counter.
-func (c *FileCacher) Incr(ctx context.Context, key string) error {
-	var i int64
-	item, err := c.read(key, &i)
-	if item != nil {
-		defer CacheItemPoolRelease(item)
-	}
+	filename := c.filepath(key)
+	f, err := c.acquire(filename)
 	if err != nil {
 		return err
 	}
+	defer c.release(filename, f)
+	return c.remove(filename)
+}
 
-	item.Val, err = Incr(i)
+// update applies fn to the int-type value stored under key while holding the
+// entry lock, keeping the original creation time and expiration.
+func (c *FileCacher) update(key string, fn func(interface{}) (interface{}, error)) error {
+	filename := c.filepath(key)
+	f, err := c.acquire(filename)
 	if err != nil {
 		return err
 	}
+	defer c.release(filename, f)
 
-	return c.Put(ctx, key, item.Val, item.Expire)
-}
-
-// Decr cached int value.
-func (c *FileCacher) Decr(ctx context.Context, key string) error {
 	var i int64
-	item, err := c.read(key, &i)
-	if item != nil {
-		defer CacheItemPoolRelease(item)
-	}
+	h, err := c.readFile(filename, &i)
 	if err != nil {
 		return err
 	}
+	if !c.owns(h, key, filename) {
+		return ErrNotFound
+	}
 
-	item.Val, err = Decr(i)
+	val, err := fn(i)
 	if err != nil {
 		return err
 	}
 
-	return c.Put(ctx, key, item.Val, item.Expire)
+	return c.put(filename, key, val, h.Created, h.Expire)
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *FileCacher) Incr(ctx context.Context, key string) error {
+	return c.update(key, Incr)
+}
+
+// Decr cached int value.
+func (c *FileCacher) Decr(ctx context.Context, key string) error {
+	return c.update(key, Decr)
 }
 
-// IsExist returns true if cached value exists.
+// IsExist returns true if cached value exists and has not expired.
+// Only the entry header is read.
 func (c *FileCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	return com.IsExist(c.filepath(key)), nil
+	filename := c.filepath(key)
+	h, err := c.header(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return c.owns(h, key, filename) && !h.hasExpired(), nil
 }
 
 // Flush deletes all cached data.
 func (c *FileCacher) Flush(ctx context.Context) error {
-	return os.RemoveAll(c.rootPath)
+	err := os.RemoveAll(c.rootPath)
+	if c.index != nil {
+		c.index.reset()
+	}
+	return err
 }
 
 func (c *FileCacher) startGC(ctx context.Context) {
@@ -211,7 +490,6 @@ func (c *FileCacher) startGC(ctx context.Context) {
 	}
 	c.lock.RUnlock()
 
-	item := &Item{}
 	if err := filepath.Walk(c.rootPath, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("walk: %v", err)
@@ -220,21 +498,36 @@ func (c *FileCacher) startGC(ctx context.Context) {
 		if fi.IsDir() {
 			return nil
 		}
-
-		data, err := os.ReadFile(path)
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("ReadFile: %v", err)
+		if strings.HasSuffix(path, fileLockSuffix) {
+			return nil
 		}
-		item.Reset()
-		if err = c.codec.Unmarshal(data, item); err != nil {
-			log.Printf("error garbage collecting cache files: unmarshal: %v", err)
-			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("remove: %v", err)
+		if strings.HasSuffix(path, fileTempSuffix) {
+			if time.Since(fi.ModTime()) > staleTempFileAge {
+				os.Remove(path)
 			}
 			return nil
 		}
-		if item.hasExpired() {
-			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+
+		h, err := c.header(path)
+		if err != nil {
+			switch {
+			case os.IsNotExist(err):
+			case errors.Is(err, errFileCorrupt):
+				log.Printf("error garbage collecting cache files: %s: %v", path, err)
+				if err = c.remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("remove: %v", err)
+				}
+			case errors.Is(err, errFileLegacy):
+				// The timestamps of a legacy entry could not be decoded
+				// with the current codec; keep it rather than lose data.
+				log.Printf("error garbage collecting cache files: %s: %v", path, err)
+			default:
+				return fmt.Errorf("read header: %v", err)
+			}
+			return nil
+		}
+		if h.hasExpired() {
+			if err = c.removeExpired(path); err != nil {
 				return fmt.Errorf("remove: %v", err)
 			}
 		}
@@ -242,25 +535,114 @@ func (c *FileCacher) startGC(ctx context.Context) {
 	}); err != nil {
 		log.Printf("error garbage collecting cache files: %v", err)
 	}
+	if err := c.evict(""); err != nil {
+		log.Printf("error evicting cache files: %v", err)
+	}
 
 	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC(ctx) })
 }
 
+// buildIndex walks the root path and loads the size of every cache file into
+// the quota index, using the modification time as the last use.
+func (c *FileCacher) buildIndex() error {
+	var entries []*fileIndexEntry
+	err := filepath.Walk(c.rootPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(path, fileLockSuffix) || strings.HasSuffix(path, fileTempSuffix) {
+			return nil
+		}
+		entries = append(entries, &fileIndexEntry{path: path, size: fi.Size(), used: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.index.load(entries)
+	return nil
+}
+
 // StartAndGC starts GC routine based on config string settings.
+// AdapterConfig is either the root directory or key/values such as:
+// path=data/caches,max_bytes=1073741824,max_files=100000,file_mode=0640,dir_mode=0750,depth=2,width=1,hash=md5,mmap=true,mmap_min_size=65536
+//
+// hash is one of md5, sha256 or xxhash. Changing hash, depth or width moves
+// every key to a different file, so existing entries are no longer found.
 func (c *FileCacher) StartAndGC(ctx context.Context, opt Options) error {
+	rootPath := opt.AdapterConfig
+	var maxBytes, maxFiles, mmapMinSize int64
+	var useMmap bool
+	layout := defaultFileLayout()
+	if strings.Contains(opt.AdapterConfig, "=") {
+		cfg, err := ini.Load([]byte(strings.Replace(opt.AdapterConfig, ",", "\n", -1)))
+		if err != nil {
+			return err
+		}
+		rootPath = ""
+		for k, v := range cfg.Section("").KeysHash() {
+			switch k {
+			case "path":
+				rootPath = v
+			case "max_bytes":
+				maxBytes = com.Int64(v)
+			case "max_files":
+				maxFiles = com.Int64(v)
+			case "mmap":
+				useMmap = com.Bool(v)
+			case "mmap_min_size":
+				mmapMinSize = com.Int64(v)
+			default:
+				if ok, err := layout.set(k, v); err != nil {
+					return err
+				} else if !ok {
+					return fmt.Errorf("cache/file: unsupported option '%s'", k)
+				}
+			}
+		}
+		if err := layout.validate(); err != nil {
+			return err
+		}
+	}
+
 	c.lock.Lock()
-	c.rootPath = opt.AdapterConfig
 	c.interval = opt.Interval
+	c.maxBytes = maxBytes
+	c.maxFiles = maxFiles
+	c.layout = layout
+	c.mmapMinSize = 0
+	if useMmap {
+		c.mmapMinSize = mmapMinSize
+		if c.mmapMinSize <= 0 {
+			c.mmapMinSize = defaultMmapMinSize
+		}
+	}
+	if maxBytes > 0 || maxFiles > 0 {
+		c.index = newFileIndex()
+	} else {
+		c.index = nil
+	}
 	var err error
-	c.rootPath, err = filepath.Abs(c.rootPath)
+	c.rootPath, err = filepath.Abs(rootPath)
 	c.lock.Unlock()
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(c.rootPath, os.ModePerm); err != nil {
+	if err := os.MkdirAll(c.rootPath, c.layout.dirMode); err != nil {
 		return err
 	}
+	if c.index != nil {
+		if err := c.buildIndex(); err != nil {
+			return err
+		}
+		if err := c.evict(""); err != nil {
+			return err
+		}
+	}
 
 	go c.startGC(ctx)
 	return nil
@@ -273,6 +655,13 @@ func (c *FileCacher) Close() error {
 	return nil
 }
 
+// RootPath returns the absolute directory holding the cache files.
+func (c *FileCacher) RootPath() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.rootPath
+}
+
 func (c *FileCacher) Client() interface{} {
 	return nil
 }
@@ -0,0 +1,15 @@
+//go:build !(darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd)
+
+package cache
+
+import "os"
+
+// flock is a no-op on platforms without flock(2). Entries are still
+// serialised between goroutines of one process by FileCacher's key locks.
+func flock(f *os.File) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
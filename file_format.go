@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/encoding/gob"
+	"github.com/admpub/cache/encoding/json"
+)
+
+// File entries start with a fixed-layout header followed by the codec
+// payload of the value:
+//
+//	magic   [4]byte  "GCFE"
+//	version uint8
+//	codec   uint8
+//	created int64    unix seconds, big endian
+//	expire  int64    seconds, 0 means it lives forever
+//	keyLen  uint16
+//	key     [keyLen]byte
+//	payload
+//
+// Files written before the header was introduced hold a codec encoded Item
+// and are still read; they are converted to the new layout when rewritten.
+const (
+	fileFormatVersion    uint8 = 1
+	fileHeaderFixedSize        = 24
+	fileHeaderMaxKeySize       = 1<<16 - 1
+)
+
+var fileMagic = [4]byte{'G', 'C', 'F', 'E'}
+
+// Codec identifiers stored in the file header.
+const (
+	fileCodecCustom uint8 = iota // the codec configured by SetCodec
+	fileCodecJSON
+	fileCodecGOB
+)
+
+var (
+	errFileLegacy  = errors.New("cache/file: legacy entry format")
+	errFileCorrupt = errors.New("cache/file: corrupt entry header")
+)
+
+// fileHeader describes a cache entry without decoding its value.
+type fileHeader struct {
+	Version uint8
+	Codec   uint8
+	Created int64
+	Expire  int64
+	Key     string
+}
+
+func (h *fileHeader) hasExpired() bool {
+	return h.Expire > 0 &&
+		(time.Now().Unix()-h.Created) >= h.Expire
+}
+
+// encode returns the header followed by payload. Keys longer than the
+// header allows are truncated.
+func (h *fileHeader) encode(payload []byte) []byte {
+	key := h.Key
+	if len(key) > fileHeaderMaxKeySize {
+		key = key[:fileHeaderMaxKeySize]
+	}
+	buf := make([]byte, fileHeaderFixedSize+len(key)+len(payload))
+	copy(buf, fileMagic[:])
+	buf[4] = h.Version
+	buf[5] = h.Codec
+	binary.BigEndian.PutUint64(buf[6:], uint64(h.Created))
+	binary.BigEndian.PutUint64(buf[14:], uint64(h.Expire))
+	binary.BigEndian.PutUint16(buf[22:], uint16(len(key)))
+	copy(buf[fileHeaderFixedSize:], key)
+	copy(buf[fileHeaderFixedSize+len(key):], payload)
+	return buf
+}
+
+// decodeFileHeader parses the header at the start of data and returns the
+// offset of the payload. It returns errFileLegacy when data has no header.
+func decodeFileHeader(data []byte) (*fileHeader, int, error) {
+	if len(data) < len(fileMagic) || !bytes.Equal(data[:len(fileMagic)], fileMagic[:]) {
+		return nil, 0, errFileLegacy
+	}
+	if len(data) < fileHeaderFixedSize {
+		return nil, 0, errFileCorrupt
+	}
+	h := &fileHeader{
+		Version: data[4],
+		Codec:   data[5],
+		Created: int64(binary.BigEndian.Uint64(data[6:])),
+		Expire:  int64(binary.BigEndian.Uint64(data[14:])),
+	}
+	if h.Version != fileFormatVersion {
+		return nil, 0, errFileCorrupt
+	}
+	end := fileHeaderFixedSize + int(binary.BigEndian.Uint16(data[22:]))
+	if len(data) < end {
+		return nil, 0, errFileCorrupt
+	}
+	h.Key = string(data[fileHeaderFixedSize:end])
+	return h, end, nil
+}
+
+// readFileHeader reads only the header of the file at filename.
+func readFileHeader(filename string) (*fileHeader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, fileHeaderFixedSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n < len(fileMagic) || !bytes.Equal(buf[:len(fileMagic)], fileMagic[:]) {
+		return nil, errFileLegacy
+	}
+	if n < fileHeaderFixedSize {
+		return nil, errFileCorrupt
+	}
+	buf = append(buf, make([]byte, binary.BigEndian.Uint16(buf[22:]))...)
+	if _, err = io.ReadFull(f, buf[fileHeaderFixedSize:]); err != nil {
+		return nil, errFileCorrupt
+	}
+	h, _, err := decodeFileHeader(buf)
+	return h, err
+}
+
+func fileCodecID(codec encoding.Codec) uint8 {
+	switch codec {
+	case json.JSON:
+		return fileCodecJSON
+	case gob.GOB:
+		return fileCodecGOB
+	default:
+		return fileCodecCustom
+	}
+}
+
+// codecByID returns the codec used to write an entry.
+func (c *FileCacher) codecByID(id uint8) encoding.Codec {
+	switch id {
+	case fileCodecJSON:
+		return json.JSON
+	case fileCodecGOB:
+		return gob.GOB
+	default:
+		return c.codec
+	}
+}
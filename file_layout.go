@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	defaultFileMode  os.FileMode = 0o666
+	defaultDirMode   os.FileMode = 0o777
+	defaultFileHash              = "md5"
+	defaultFileDepth             = 2
+	defaultFileWidth             = 1
+)
+
+// fileHashes maps the names accepted by the hash option to functions that
+// return the hex digest of a key.
+var fileHashes = map[string]func(string) string{
+	"md5": func(key string) string {
+		m := md5.Sum([]byte(key))
+		return hex.EncodeToString(m[:])
+	},
+	"sha256": func(key string) string {
+		m := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(m[:])
+	},
+	"xxhash": func(key string) string {
+		return fmt.Sprintf("%016x", xxhash.Sum64String(key))
+	},
+}
+
+// fileLayout describes how keys are mapped to files below the root path.
+type fileLayout struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	depth    int // number of directory levels
+	width    int // hash characters per directory level
+	hashName string
+	hash     func(string) string
+}
+
+func defaultFileLayout() fileLayout {
+	return fileLayout{
+		fileMode: defaultFileMode,
+		dirMode:  defaultDirMode,
+		depth:    defaultFileDepth,
+		width:    defaultFileWidth,
+		hashName: defaultFileHash,
+		hash:     fileHashes[defaultFileHash],
+	}
+}
+
+// set applies a layout option from AdapterConfig. It reports false when k is
+// not a layout option.
+func (l *fileLayout) set(k string, v string) (bool, error) {
+	switch k {
+	case "file_mode", "dir_mode":
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return true, fmt.Errorf("cache/file: invalid %s '%s': %v", k, v, err)
+		}
+		if k == "file_mode" {
+			l.fileMode = os.FileMode(mode) & os.ModePerm
+		} else {
+			l.dirMode = os.FileMode(mode) & os.ModePerm
+		}
+	case "depth", "width":
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("cache/file: invalid %s '%s'", k, v)
+		}
+		if k == "depth" {
+			l.depth = n
+		} else {
+			l.width = n
+		}
+	case "hash":
+		hash, ok := fileHashes[v]
+		if !ok {
+			return true, fmt.Errorf("cache/file: unsupported hash '%s'", v)
+		}
+		l.hashName = v
+		l.hash = hash
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (l *fileLayout) validate() error {
+	if l.depth > 0 && l.width < 1 {
+		return fmt.Errorf("cache/file: width must be positive when depth is %d", l.depth)
+	}
+	if size := len(l.hash("")); l.depth*l.width > size {
+		return fmt.Errorf("cache/file: depth*width exceeds the %d characters of a %s digest", size, l.hashName)
+	}
+	return nil
+}
+
+// path returns the file holding key below root.
+func (l *fileLayout) path(root string, key string) string {
+	hash := l.hash(key)
+	parts := make([]string, 0, l.depth+2)
+	parts = append(parts, root)
+	for i := 0; i < l.depth; i++ {
+		parts = append(parts, hash[i*l.width:(i+1)*l.width])
+	}
+	parts = append(parts, hash)
+	return filepath.Join(parts...)
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// defaultMmapMinSize is the entry size from which GetBytes and GetReader
+// map the file instead of reading it when mmap is enabled.
+const defaultMmapMinSize = 64 << 10
+
+// GetBytes returns the raw codec payload stored under key. When mmap is
+// enabled and the entry is at least mmap_min_size bytes, the payload is
+// served straight from a read-only mapping of the entry file without being
+// copied. The returned release function must be called once the payload is
+// no longer used; the slice must not be accessed afterwards.
+//
+// Entries are replaced by renaming a new file over the old one and removed
+// by unlinking, so a mapping keeps seeing the entry it was created from even
+// when GC or another writer removes it in the meantime.
+//
+// An entry in the legacy format, which has no payload of its own, is
+// rewritten in the current format on first read, see upgrade.
+func (c *FileCacher) GetBytes(ctx context.Context, key string) ([]byte, func() error, error) {
+	filename := c.filepath(key)
+	data, release, err := c.getBytes(filename, key)
+	if err != errFileLegacy {
+		return data, release, err
+	}
+	if err = c.upgrade(filename, key); err != nil {
+		return nil, nil, err
+	}
+	data, release, err = c.getBytes(filename, key)
+	if err == errFileLegacy {
+		err = fmt.Errorf("%w: %s is stored in the legacy format", ErrNotSupported, key)
+	}
+	return data, release, err
+}
+
+// upgrade rewrites the legacy entry of key stored at filename in the current
+// format. Its value is decoded without a type, so it is stored again as the
+// codec decodes such values, e.g. JSON objects as maps.
+func (c *FileCacher) upgrade(filename string, key string) error {
+	f, err := c.acquire(filename)
+	if err != nil {
+		return err
+	}
+	defer c.release(filename, f)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if _, _, err = decodeFileHeader(data); err != errFileLegacy {
+		// Rewritten in the meantime.
+		return err
+	}
+	item := &Item{}
+	if err = c.codec.Unmarshal(data, item); err != nil {
+		return err
+	}
+	if item.Val == nil {
+		return ErrNotFound
+	}
+	return c.put(filename, key, item.Val, item.Created, item.Expire)
+}
+
+// getBytes is GetBytes without the upgrade of legacy entries, for which it
+// returns errFileLegacy.
+func (c *FileCacher) getBytes(filename string, key string) ([]byte, func() error, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		data    []byte
+		release func() error
+	)
+	if c.mmapMinSize > 0 && fi.Size() >= c.mmapMinSize {
+		data, release, err = mapFile(f, fi.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if data == nil {
+		if data, err = io.ReadAll(f); err != nil {
+			return nil, nil, err
+		}
+		release = func() error { return nil }
+	}
+	release = releaseOnce(release)
+
+	h, offset, err := decodeFileHeader(data)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if !c.owns(h, key, filename) {
+		release()
+		return nil, nil, ErrNotFound
+	}
+	if h.hasExpired() {
+		release()
+		c.removeExpired(filename)
+		return nil, nil, ErrExpired
+	}
+	if c.index != nil {
+		c.index.touch(filename)
+	}
+	return data[offset:], release, nil
+}
+
+// GetReader returns a reader over the raw codec payload stored under key.
+// Closing the reader releases the underlying mapping, see GetBytes.
+func (c *FileCacher) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, release, err := c.GetBytes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadReader{Reader: bytes.NewReader(data), release: release}, nil
+}
+
+type payloadReader struct {
+	*bytes.Reader
+	release func() error
+}
+
+func (r *payloadReader) Close() error {
+	r.Reader = bytes.NewReader(nil)
+	return r.release()
+}
+
+// releaseOnce makes a release function safe to call more than once.
+func releaseOnce(release func() error) func() error {
+	var (
+		once sync.Once
+		err  error
+	)
+	return func() error {
+		once.Do(func() { err = release() })
+		return err
+	}
+}
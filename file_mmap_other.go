@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package cache
+
+import "os"
+
+// mapFile never maps on this platform: mapped files cannot be removed or
+// replaced on Windows, which would break Delete, Put and GC, and mmap-go
+// does not support the remaining platforms. Entries are read instead.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, nil
+}
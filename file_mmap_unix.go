@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package cache
+
+import (
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// mapFile maps size bytes of f read-only. The mapping stays valid after f is
+// closed, unlinked or replaced.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	m, err := mmap.MapRegion(f, int(size), mmap.RDONLY, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, m.Unmap, nil
+}
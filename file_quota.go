@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileIndex tracks the size and recency of the files below a FileCacher root
+// so that the disk quota can be enforced without walking the directory on
+// every write. It only sees the writes of the current process; files written
+// by other processes are picked up when the index is rebuilt.
+type fileIndex struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front is the most recently used file
+	bytes int64
+}
+
+type fileIndexEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{items: make(map[string]*list.Element), lru: list.New()}
+}
+
+// load replaces the index content with entries, ordered by their last use.
+func (x *fileIndex) load(entries []*fileIndexEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.After(entries[j].used)
+	})
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.items = make(map[string]*list.Element, len(entries))
+	x.lru.Init()
+	x.bytes = 0
+	for _, ent := range entries {
+		x.items[ent.path] = x.lru.PushBack(ent)
+		x.bytes += ent.size
+	}
+}
+
+// set records a file written with size bytes as the most recently used one.
+func (x *fileIndex) set(path string, size int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.items[path]; ok {
+		ent := e.Value.(*fileIndexEntry)
+		x.bytes += size - ent.size
+		ent.size = size
+		ent.used = time.Now()
+		x.lru.MoveToFront(e)
+		return
+	}
+	x.items[path] = x.lru.PushFront(&fileIndexEntry{path: path, size: size, used: time.Now()})
+	x.bytes += size
+}
+
+// touch marks a file as just read.
+func (x *fileIndex) touch(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.items[path]; ok {
+		e.Value.(*fileIndexEntry).used = time.Now()
+		x.lru.MoveToFront(e)
+	}
+}
+
+func (x *fileIndex) remove(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.items[path]; ok {
+		x.bytes -= e.Value.(*fileIndexEntry).size
+		x.lru.Remove(e)
+		delete(x.items, path)
+	}
+}
+
+func (x *fileIndex) reset() {
+	x.load(nil)
+}
+
+func (x *fileIndex) usage() (bytes int64, files int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.bytes, int64(x.lru.Len())
+}
+
+// victims returns the least recently used files that have to be removed for
+// the usage to fit within maxBytes and maxFiles. A limit of 0 means no limit.
+// keep is never returned, so the file that was just written survives even
+// when it alone exceeds the quota.
+func (x *fileIndex) victims(maxBytes int64, maxFiles int64, keep string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	bytes, files := x.bytes, int64(x.lru.Len())
+	var paths []string
+	for e := x.lru.Back(); e != nil; e = e.Prev() {
+		if (maxBytes <= 0 || bytes <= maxBytes) && (maxFiles <= 0 || files <= maxFiles) {
+			break
+		}
+		ent := e.Value.(*fileIndexEntry)
+		if ent.path == keep {
+			continue
+		}
+		paths = append(paths, ent.path)
+		bytes -= ent.size
+		files--
+	}
+	return paths
+}
@@ -2,9 +2,23 @@ package cache_test
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/admpub/cache"
+	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,3 +73,314 @@ func TestFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, wraps, recv3)
 }
+
+func TestFileConcurrentIncr(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: t.TempDir()}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "counter", int64(0), 0))
+
+	const goroutines, loops = 16, 50
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < loops; j++ {
+				assert.NoError(t, c.Incr(ctx, "counter"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(goroutines*loops), c.Int64(ctx, "counter"))
+}
+
+func TestFileConcurrentPutGet(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: t.TempDir()}))
+	defer c.Close()
+	value := strings.Repeat("x", 1<<20)
+	assert.NoError(t, c.Put(ctx, "big", value, 0))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, c.Put(ctx, "big", value, 0))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var recv string
+				if assert.NoError(t, c.Get(ctx, "big", &recv)) {
+					assert.Equal(t, len(value), len(recv))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	matches, err := filepath.Glob(filepath.Join(c.RootPath(), "*", "*", "*.tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+const fileHelperRootEnv = "CACHE_FILE_TEST_ROOT"
+
+// TestFileHelperProcess is run as a child process by TestFileConcurrentProcesses.
+func TestFileHelperProcess(t *testing.T) {
+	root := os.Getenv(fileHelperRootEnv)
+	if len(root) == 0 {
+		t.Skip("helper process only")
+	}
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: root}))
+	defer c.Close()
+	for i := 0; i < 50; i++ {
+		if err := c.Incr(ctx, "counter"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileConcurrentProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "solaris" || runtime.GOOS == "aix" {
+		t.Skip("flock is not available on " + runtime.GOOS)
+	}
+	ctx := context.Background()
+	root := t.TempDir()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: root}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "counter", int64(0), 0))
+
+	const processes = 4
+	cmds := make([]*exec.Cmd, processes)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFileHelperProcess$")
+		cmd.Env = append(os.Environ(), fileHelperRootEnv+"="+root)
+		assert.NoError(t, cmd.Start())
+		cmds[i] = cmd
+	}
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, c.Incr(ctx, "counter"))
+	}
+	for _, cmd := range cmds {
+		assert.NoError(t, cmd.Wait())
+	}
+	assert.Equal(t, int64((processes+1)*50), c.Int64(ctx, "counter"))
+}
+
+func TestFileQuota(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + root + ",max_files=3"}))
+	defer c.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, c.Put(ctx, key, key, 0))
+	}
+	assert.Equal(t, "a", c.String(ctx, "a"))
+
+	// "b" is now the least recently used entry.
+	assert.NoError(t, c.Put(ctx, "d", "d", 0))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		exist, err := c.IsExist(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, exist, key)
+	}
+	_, files := c.Usage()
+	assert.Equal(t, int64(3), files)
+
+	// The index is rebuilt from the files on disk.
+	c2 := cache.NewFileCacher()
+	assert.NoError(t, c2.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + root + ",max_files=2"}))
+	defer c2.Close()
+	_, files = c2.Usage()
+	assert.Equal(t, int64(2), files)
+}
+
+func TestFileQuotaBytes(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + t.TempDir() + ",max_bytes=4096"}))
+	defer c.Close()
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.Put(ctx, strconv.Itoa(i), value, 0))
+		bytes, _ := c.Usage()
+		assert.LessOrEqual(t, bytes, int64(4096))
+	}
+	exist, err := c.IsExist(ctx, "9")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	exist, err = c.IsExist(ctx, "0")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+}
+
+func TestFileLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: root}))
+	defer c.Close()
+	writeLegacy := func(key string, item *cache.Item) string {
+		m := md5.Sum([]byte(key))
+		hash := hex.EncodeToString(m[:])
+		filename := filepath.Join(root, hash[0:1], hash[1:2], hash)
+		data, err := c.Codec().Marshal(item)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filename), os.ModePerm))
+		assert.NoError(t, os.WriteFile(filename, data, os.ModePerm))
+		return filename
+	}
+
+	now := time.Now().Unix()
+	filename := writeLegacy("counter", &cache.Item{Val: int64(41), Created: now})
+	assert.Equal(t, int64(41), c.Int64(ctx, "counter"))
+	exist, err := c.IsExist(ctx, "counter")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	// Rewriting an entry converts it to the current format.
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.Equal(t, int64(42), c.Int64(ctx, "counter"))
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "GCFE"))
+
+	writeLegacy("expired", &cache.Item{Val: "stale", Created: now - 100, Expire: 10})
+	exist, err = c.IsExist(ctx, "expired")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	var stale string
+	assert.Equal(t, cache.ErrExpired, c.Get(ctx, "expired", &stale))
+	assert.Equal(t, "stale", stale)
+
+	// Reading the payload of an entry converts it to the current format.
+	filename = writeLegacy("doc", &cache.Item{Val: "legacy", Created: now})
+	payload, release, err := c.GetBytes(ctx, "doc")
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"legacy"`, string(payload))
+		assert.NoError(t, release())
+	}
+	data, err = os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "GCFE"))
+	assert.Equal(t, "legacy", c.String(ctx, "doc"))
+
+	writeLegacy("expired", &cache.Item{Val: "stale", Created: now - 100, Expire: 10})
+	_, _, err = c.GetBytes(ctx, "expired")
+	assert.Equal(t, cache.ErrExpired, err)
+}
+
+func TestFileExpiredHeader(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: t.TempDir()}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "short", "value", 1))
+	exist, err := c.IsExist(ctx, "short")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	time.Sleep(1100 * time.Millisecond)
+	exist, err = c.IsExist(ctx, "short")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	var value string
+	assert.Equal(t, cache.ErrExpired, c.Get(ctx, "short", &value))
+	assert.Equal(t, "value", value)
+}
+
+func TestFileLayout(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + root + ",hash=sha256,depth=3,width=2,file_mode=0640,dir_mode=0750"}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+
+	m := sha256.Sum256([]byte("key"))
+	hash := hex.EncodeToString(m[:])
+	filename := filepath.Join(root, hash[0:2], hash[2:4], hash[4:6], hash)
+	fi, err := os.Stat(filename)
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Zero(t, fi.Mode().Perm()&^0o640)
+		di, err := os.Stat(filepath.Dir(filename))
+		assert.NoError(t, err)
+		assert.Zero(t, di.Mode().Perm()&^0o750)
+	}
+
+	for _, config := range []string{"hash=crc", "depth=20,width=4", "file_mode=rw"} {
+		err := cache.NewFileCacher().StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + root + "," + config})
+		assert.Error(t, err, config)
+	}
+}
+
+func TestFileKeyCollision(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + root + ",hash=xxhash,depth=1,width=2"}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "a", "value of a", 0))
+
+	// Simulate a digest collision by storing the entry of "a" in the file of "b".
+	path := func(key string) string {
+		hash := fmt.Sprintf("%016x", xxhash.Sum64String(key))
+		return filepath.Join(root, hash[0:2], hash)
+	}
+	data, err := os.ReadFile(path("a"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path("b")), os.ModePerm))
+	assert.NoError(t, os.WriteFile(path("b"), data, os.ModePerm))
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "b", &value))
+	exist, err := c.IsExist(ctx, "b")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	assert.Equal(t, "value of a", c.String(ctx, "a"))
+}
+
+func TestFileGetBytes(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewFileCacher()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + t.TempDir() + ",mmap=true,mmap_min_size=1024"}))
+	defer c.Close()
+	value := strings.Repeat("document ", 1<<16)
+	assert.NoError(t, c.Put(ctx, "doc", value, 0))
+	assert.NoError(t, c.Put(ctx, "small", "tiny", 0))
+	want, err := c.Codec().Marshal(value)
+	assert.NoError(t, err)
+
+	data, release, err := c.GetBytes(ctx, "doc")
+	if assert.NoError(t, err) {
+		// The mapping outlives a rewrite and the removal of the entry.
+		assert.NoError(t, c.Put(ctx, "doc", "replaced", 0))
+		assert.NoError(t, c.Delete(ctx, "doc"))
+		assert.Equal(t, want, data)
+		assert.NoError(t, release())
+		assert.NoError(t, release())
+	}
+
+	r, err := c.GetReader(ctx, "small")
+	if assert.NoError(t, err) {
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, `"tiny"`, string(b))
+		assert.NoError(t, r.Close())
+	}
+
+	_, _, err = c.GetBytes(ctx, "doc")
+	assert.Equal(t, cache.ErrNotFound, err)
+}
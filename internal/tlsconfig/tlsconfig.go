@@ -0,0 +1,82 @@
+// Package tlsconfig builds the TLS configuration of the network adapters
+// from their tls_ AdapterConfig options.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/webx-top/com"
+)
+
+// Options are the TLS settings of an adapter.
+type Options struct {
+	Enabled            bool   // tls
+	CAFile             string // tls_ca_file, PEM certificates trusted besides the system pool
+	CertFile           string // tls_cert_file, PEM client certificate
+	KeyFile            string // tls_key_file, PEM key of the client certificate
+	ServerName         string // tls_server_name, overrides the name checked in the server certificate
+	InsecureSkipVerify bool   // tls_insecure_skip_verify
+}
+
+// Set applies the option k if it is a TLS option and reports whether it
+// was. Setting any tls_ option enables TLS.
+func (o *Options) Set(k string, v string) bool {
+	if k != "tls" && !strings.HasPrefix(k, "tls_") {
+		return false
+	}
+	switch k {
+	case "tls":
+		o.Enabled = com.Bool(v)
+		return true
+	case "tls_ca_file":
+		o.CAFile = v
+	case "tls_cert_file":
+		o.CertFile = v
+	case "tls_key_file":
+		o.KeyFile = v
+	case "tls_server_name":
+		o.ServerName = v
+	case "tls_insecure_skip_verify":
+		o.InsecureSkipVerify = com.Bool(v)
+	default:
+		return false
+	}
+	o.Enabled = true
+	return true
+}
+
+// Config returns the client TLS configuration, or nil if TLS is disabled.
+func (o *Options) Config() (*tls.Config, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if len(o.CAFile) > 0 {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: reading CA file: %w", err)
+		}
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificate found in %s", o.CAFile)
+		}
+	}
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,48 @@
+package tlsconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache/internal/tlsconfig/tlsconfigtest"
+)
+
+func TestOptions(t *testing.T) {
+	var o Options
+	assert.False(t, o.Set("addr", "localhost:6379"))
+	config, err := o.Config()
+	assert.NoError(t, err)
+	assert.Nil(t, config, "TLS is disabled by default")
+
+	files, _ := tlsconfigtest.WriteFiles(t)
+	assert.True(t, o.Set("tls_ca_file", files.CAFile))
+	assert.True(t, o.Set("tls_cert_file", files.CertFile))
+	assert.True(t, o.Set("tls_key_file", files.KeyFile))
+	assert.True(t, o.Set("tls_server_name", "redis.internal"))
+	assert.False(t, o.Set("tls_unknown", "1"))
+	config, err = o.Config()
+	assert.NoError(t, err)
+	assert.Equal(t, "redis.internal", config.ServerName)
+	assert.Len(t, config.Certificates, 1)
+	assert.NotNil(t, config.RootCAs)
+
+	o = Options{}
+	assert.True(t, o.Set("tls", "true"))
+	config, err = o.Config()
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	assert.NoError(t, os.WriteFile(empty, nil, 0600))
+	for _, o := range []Options{
+		{Enabled: true, CAFile: empty},
+		{Enabled: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{Enabled: true, CertFile: files.CertFile},
+	} {
+		_, err = o.Config()
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,103 @@
+// Package tlsconfigtest provides certificates for testing TLS connections.
+package tlsconfigtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files are the PEM files written by WriteFiles.
+type Files struct {
+	CAFile   string // certificate of the CA signing the other certificates
+	CertFile string // client certificate
+	KeyFile  string // key of the client certificate
+}
+
+// WriteFiles creates a CA with a server certificate for localhost and
+// 127.0.0.1 and a client certificate. It writes the CA and the client
+// certificate to a temporary directory and returns the server configuration,
+// which requires a client certificate signed by the CA.
+func WriteFiles(t testing.TB) (Files, *tls.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, caCert := newCertificate(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "cache test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	serverKey, serverCert := newCertificate(t, caKey, caCert, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientKey, clientCert := newCertificate(t, caKey, caCert, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "cache test client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	files := Files{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	writePEM(t, files.CAFile, "CERTIFICATE", caCert.Raw)
+	writePEM(t, files.CertFile, "CERTIFICATE", clientCert.Raw)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, files.KeyFile, "EC PRIVATE KEY", der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	return files, server
+}
+
+var serial int64
+
+func newCertificate(t testing.TB, parentKey *ecdsa.PrivateKey, parent *x509.Certificate, template *x509.Certificate) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func writePEM(t testing.TB, path string, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -17,7 +17,9 @@ package cache
 import (
 	"context"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/admpub/ledisdb/config"
@@ -29,14 +31,26 @@ import (
 	"github.com/admpub/ini"
 )
 
-var defaultHSetName = []byte("Cache")
-
 // LedisCacher represents a ledis cache adapter implementation.
+//
+// Every key put is recorded in a hash named after the prefix, holding the
+// unix time at which the key expires, or 0, so that expired keys are not
+// read before the TTL checker of ledis deletes them, and Flush deletes only
+// the keys of this cache when the database is shared with other data. The
+// records of the expired keys are pruned every Interval seconds.
 type LedisCacher struct {
 	cache.GetAs
-	codec encoding.Codec
-	c     *ledis.Ledis
-	db    *ledis.DB
+	codec      encoding.Codec
+	c          *ledis.Ledis
+	db         *ledis.DB
+	prefix     string
+	hsetName   []byte
+	occupyMode bool
+	// mu serialises the updates of the registry, so that pruning never
+	// drops the record of a key put meanwhile.
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func (c *LedisCacher) SetCodec(codec encoding.Codec) {
@@ -47,6 +61,30 @@ func (c *LedisCacher) Codec() encoding.Codec {
 	return c.codec
 }
 
+func (c *LedisCacher) key(key string) []byte {
+	return []byte(c.prefix + key)
+}
+
+// register records the deadline of key in the registry hash.
+func (c *LedisCacher) register(key []byte, deadline int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.HSet(c.hsetName, key, []byte(com.ToStr(deadline)))
+	return err
+}
+
+// expired reports whether the deadline of key has passed. An expired key
+// lives until the TTL checker of ledis deletes it, and reports no
+// expiration meanwhile, so the registry tells it apart.
+func (c *LedisCacher) expired(key []byte) (bool, error) {
+	deadline, err := c.db.HGet(c.hsetName, key)
+	if err != nil {
+		return false, err
+	}
+	n := com.Int64(string(deadline))
+	return n > 0 && n <= time.Now().Unix(), nil
+}
+
 // Put puts value into cache with key and expire time.
 // If expired is 0, it lives forever.
 func (c *LedisCacher) Put(ctx context.Context, key string, val interface{}, expire int64) (err error) {
@@ -54,40 +92,56 @@ func (c *LedisCacher) Put(ctx context.Context, key string, val interface{}, expi
 	if err != nil {
 		return err
 	}
-	kBytes := []byte(key)
-	if expire == 0 {
+	kBytes := c.key(key)
+	if expire <= 0 {
 		if err = c.db.Set(kBytes, value); err != nil {
 			return err
 		}
-		_, err = c.db.HSet(kBytes, defaultHSetName, []byte("0"))
-		return err
+		// Set keeps the expiration of a previous value.
+		if _, err = c.db.Persist(kBytes); err != nil {
+			return err
+		}
+		return c.register(kBytes, 0)
 	}
 
 	if err = c.db.SetEX(kBytes, expire, value); err != nil {
 		return err
 	}
-	_, err = c.db.HSet(kBytes, defaultHSetName, []byte(com.ToStr(time.Now().Add(time.Duration(expire)*time.Second).Unix())))
-	return err
+	return c.register(kBytes, time.Now().Add(time.Duration(expire)*time.Second).Unix())
 }
 
 // Get gets cached value by given key.
 func (c *LedisCacher) Get(ctx context.Context, key string, value interface{}) error {
-	val, err := c.db.Get([]byte(key))
+	kBytes := c.key(key)
+	val, err := c.db.Get(kBytes)
 	if err != nil {
 		return err
 	}
 	if len(val) == 0 {
 		return cache.ErrNotFound
 	}
+	if expired, err := c.expired(kBytes); expired || err != nil {
+		if err == nil {
+			err = cache.ErrNotFound
+		}
+		return err
+	}
 	return c.codec.Unmarshal(val, value)
 }
 
 // Delete deletes cached value by given key.
 func (c *LedisCacher) Delete(ctx context.Context, key string) (err error) {
-	if _, err = c.db.Del([]byte(key)); err != nil {
+	kBytes := c.key(key)
+	if _, err = c.db.Del(kBytes); err != nil {
 		return err
 	}
-	_, err = c.db.HDel(defaultHSetName, []byte(key))
+	return c.unregister(kBytes)
+}
+
+func (c *LedisCacher) unregister(key []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.db.HDel(c.hsetName, key)
 	return err
 }
 
@@ -99,7 +153,7 @@ func (c *LedisCacher) Incr(ctx context.Context, key string) error {
 		}
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	_, err := c.db.Incr([]byte(key))
+	_, err := c.db.Incr(c.key(key))
 	return err
 }
 
@@ -111,39 +165,163 @@ func (c *LedisCacher) Decr(ctx context.Context, key string) error {
 		}
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	_, err := c.db.Decr([]byte(key))
+	_, err := c.db.Decr(c.key(key))
 	return err
 }
 
 // IsExist returns true if cached value exists.
 func (c *LedisCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	count, err := c.db.Exists([]byte(key))
-	if err == nil && count > 0 {
-		return true, nil
+	kBytes := c.key(key)
+	count, err := c.db.Exists(kBytes)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	return false, c.unregister(kBytes)
+}
+
+// TTL returns the number of seconds before key expires, or 0 if it lives
+// forever.
+func (c *LedisCacher) TTL(ctx context.Context, key string) (int64, error) {
+	kBytes := c.key(key)
+	if exist, err := c.IsExist(ctx, key); !exist {
+		if err != nil {
+			return 0, err
+		}
+		return 0, cache.ErrNotFound
+	}
+	ttl, err := c.db.TTL(kBytes)
+	if err != nil {
+		return 0, err
+	}
+	if ttl > 0 {
+		return ttl, nil
+	}
+	if expired, err := c.expired(kBytes); expired || err != nil {
+		if err == nil {
+			err = cache.ErrNotFound
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Persist removes the expiration of key, which then lives forever.
+func (c *LedisCacher) Persist(ctx context.Context, key string) error {
+	if _, err := c.TTL(ctx, key); err != nil {
+		return err
+	}
+	kBytes := c.key(key)
+	if _, err := c.db.Persist(kBytes); err != nil {
+		return err
 	}
-	c.db.HDel(defaultHSetName, []byte(key))
-	return false, err
+	return c.register(kBytes, 0)
 }
 
 // Flush deletes all cached data.
 func (c *LedisCacher) Flush(ctx context.Context) error {
-	// FIXME: there must be something wrong, shouldn't use this one.
-	_, err := c.db.FlushAll()
+	if c.occupyMode {
+		_, err := c.db.FlushAll()
+		return err
+	}
+
+	keys, err := c.db.HKeys(c.hsetName)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := min(delBatchSize, len(keys))
+		if _, err = c.db.Del(keys[:n]...); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	_, err = c.db.HClear(c.hsetName)
 	return err
+}
 
-	// keys, err := c.c.HKeys(defaultHSetName)
-	// if err != nil {
-	// 	return err
-	// }
-	// if _, err = c.c.Del(keys...); err != nil {
-	// 	return err
-	// }
-	// _, err = c.c.Del(defaultHSetName)
-	// return err
+// delBatchSize bounds the number of keys deleted per batch.
+const delBatchSize = 500
+
+// Prune removes the records of the expired keys from the registry, and
+// returns their number.
+func (c *LedisCacher) Prune(ctx context.Context) (int, error) {
+	var pruned int
+	var cursor []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		pairs, err := c.db.HScan(c.hsetName, cursor, delBatchSize, false, "")
+		if err != nil || len(pairs) == 0 {
+			return pruned, err
+		}
+		now := time.Now().Unix()
+		var fields [][]byte
+		for _, pair := range pairs {
+			if n := com.Int64(string(pair.Value)); n > 0 && n <= now {
+				fields = append(fields, pair.Field)
+			}
+		}
+		cursor = pairs[len(pairs)-1].Field
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := c.pruneFields(fields, now)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+}
+
+// pruneFields removes the records of fields whose deadline is still
+// before now.
+func (c *LedisCacher) pruneFields(fields [][]byte, now int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadlines, err := c.db.HMget(c.hsetName, fields...)
+	if err != nil {
+		return 0, err
+	}
+	expired := fields[:0]
+	for i, deadline := range deadlines {
+		if n := com.Int64(string(deadline)); n > 0 && n <= now {
+			expired = append(expired, fields[i])
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	n, err := c.db.HDel(c.hsetName, expired...)
+	return int(n), err
+}
+
+func (c *LedisCacher) startGC(ctx context.Context, interval int) {
+	defer c.wg.Done()
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		if _, err := c.Prune(ctx); err != nil && err != ctx.Err() {
+			log.Printf("cache/ledis: error pruning the registry: %v", err)
+		}
+	}
 }
 
 // StartAndGC starts GC routine based on config string settings.
-// AdapterConfig: data_dir=./app.db,db=0
+// AdapterConfig: data_dir=./app.db,db=0,prefix=cache:
+//
+// Keys are stored with the prefix, and recorded in the hset_name hash,
+// which defaults to the prefix followed by "Cache". Caches sharing a
+// database need distinct prefixes. With OccupyMode, Flush empties the
+// database. Interval sets both the TTL check of ledis and the pruning of
+// the registry.
 func (c *LedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
 
 	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
@@ -152,31 +330,52 @@ func (c *LedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error
 	}
 
 	db := 0
-	opt := new(config.Config)
+	opt := config.NewConfigDefault()
+	var hsetName string
+	c.prefix = ""
 	for k, v := range cfg.Section("").KeysHash() {
 		switch k {
 		case "data_dir":
 			opt.DataDir = v
 		case "db":
 			db = com.Int(v)
+		case "prefix":
+			c.prefix = v
+		case "hset_name":
+			hsetName = v
 		default:
 			return fmt.Errorf("cache/ledis: unsupported option '%s'", k)
 		}
 	}
+	if len(hsetName) == 0 {
+		hsetName = c.prefix + "Cache"
+	}
+	c.hsetName = []byte(hsetName)
+	c.occupyMode = opts.OccupyMode
 	opt.TTLCheckInterval = opts.Interval
 	c.c, err = ledis.Open(opt)
 	if err != nil {
 		return fmt.Errorf("cache/ledis: error opening db: %v", err)
 	}
-	c.db, err = c.c.Select(db) // with gc
-	return err
+	if c.db, err = c.c.Select(db); err != nil { // with gc
+		return err
+	}
+	c.done = make(chan struct{})
+	if opts.Interval > 0 {
+		c.wg.Add(1)
+		go c.startGC(ctx, opts.Interval)
+	}
+	return nil
 }
 
 func (c *LedisCacher) Close() error {
 	if c.c == nil {
 		return nil
 	}
+	close(c.done)
+	c.wg.Wait()
 	c.c.Close()
+	c.c = nil
 	return nil
 }
 
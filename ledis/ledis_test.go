@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LedisCacher)
+	err := c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir() + `,prefix=cache:`,
+		Interval:      1,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Implements(t, (*cache.Cache)(nil), c)
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+	exist, err := c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	stored, err := c.db.Get([]byte("cache:key"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, stored)
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "missing", &value))
+	exist, err = c.IsExist(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	assert.NoError(t, c.Put(ctx, "counter", 1, 0))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, 2, c.Int(ctx, "counter"))
+	assert.Error(t, c.Incr(ctx, "missing"))
+
+	assert.NoError(t, c.Delete(ctx, "key"))
+	exist, err = c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	keys, err := c.db.HKeys([]byte("cache:Cache"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("cache:counter")}, keys)
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LedisCacher)
+	err := c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir(),
+		Interval:      1,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	ttl, err := c.TTL(ctx, "key")
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, ttl, 1)
+
+	assert.NoError(t, c.Persist(ctx, "key"))
+	ttl, err = c.TTL(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), ttl)
+	_, err = c.TTL(ctx, "missing")
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.Equal(t, cache.ErrNotFound, c.Persist(ctx, "missing"))
+
+	// Putting a value without expiration drops the previous one.
+	assert.NoError(t, c.Put(ctx, "short", "value", 1))
+	assert.NoError(t, c.Put(ctx, "short", "value", 0))
+	assert.NoError(t, c.Put(ctx, "expiring", "value", 1))
+	time.Sleep(2100 * time.Millisecond)
+	_, err = c.TTL(ctx, "expiring")
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.Equal(t, cache.ErrNotFound, c.Persist(ctx, "expiring"))
+	assert.Equal(t, "value", c.String(ctx, "short"))
+
+	// A key past its deadline is missing before the TTL checker runs.
+	assert.NoError(t, c.Put(ctx, "stale", "value", 60))
+	assert.NoError(t, c.register(c.key("stale"), time.Now().Unix()-1))
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "stale", &value))
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LedisCacher)
+	err := c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir() + `,prefix=cache:`,
+		Interval:      1,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	assert.NoError(t, c.Put(ctx, "live", "value", 60))
+	assert.NoError(t, c.Put(ctx, "forever", "value", 0))
+	for i := 0; i < delBatchSize+10; i++ {
+		assert.NoError(t, c.register(c.key(fmt.Sprint("gone", i)), time.Now().Unix()-1))
+	}
+	_, err = c.Prune(ctx)
+	assert.NoError(t, err)
+	keys, err := c.db.HKeys([]byte("cache:Cache"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("cache:forever"), []byte("cache:live")}, keys)
+
+	// The keys expiring naturally are pruned by the GC.
+	assert.NoError(t, c.Put(ctx, "short", "value", 1))
+	time.Sleep(3100 * time.Millisecond)
+	n, err := c.db.HLen([]byte("cache:Cache"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestOccupyModeExpiry(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LedisCacher)
+	err := c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir(),
+		Interval:      1,
+		OccupyMode:    true,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// A key past its deadline is missing before the TTL checker runs.
+	assert.NoError(t, c.Put(ctx, "stale", "value", 60))
+	assert.NoError(t, c.register(c.key("stale"), time.Now().Unix()-1))
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "stale", &value))
+
+	assert.NoError(t, c.Put(ctx, "live", "value", 60))
+	pruned, err := c.Prune(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.Equal(t, "value", c.String(ctx, "live"))
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LedisCacher)
+	err := c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir() + `,prefix=cache:`,
+		Interval:      1,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// Data of others in the same database.
+	other := []byte("other")
+	assert.NoError(t, c.db.Set(other, []byte("value")))
+	_, err = c.db.HSet(other, []byte("field"), []byte("value"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Put(ctx, "a", "value", 0))
+	assert.NoError(t, c.Put(ctx, "b", "value", 60))
+	assert.NoError(t, c.Flush(ctx))
+	for _, key := range []string{"a", "b"} {
+		exist, err := c.IsExist(ctx, key)
+		assert.NoError(t, err)
+		assert.False(t, exist)
+	}
+	n, err := c.db.HLen([]byte("cache:Cache"))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	value, err := c.db.Get(other)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	value, err = c.db.HGet(other, []byte("field"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	// In occupy mode, the database belongs to the cache.
+	c = New().(*LedisCacher)
+	err = c.StartAndGC(ctx, cache.Options{
+		AdapterConfig: `data_dir=` + t.TempDir(),
+		Interval:      1,
+		OccupyMode:    true,
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.NoError(t, c.db.Set(other, []byte("value")))
+	assert.NoError(t, c.Put(ctx, "a", "value", 0))
+	n, err = c.db.HLen([]byte("Cache"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n, "the deadlines are recorded")
+	assert.NoError(t, c.Flush(ctx))
+	n, err = c.db.Exists(other)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	n, err = c.db.HLen([]byte("Cache"))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `data_dir=` + t.TempDir() + `,unknown=1`})
+	assert.EqualError(t, err, "cache/ledis: unsupported option 'unknown'")
+}
@@ -0,0 +1,508 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/webx-top/com"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding"
+	"github.com/admpub/ini"
+)
+
+// LevelDBCacher represents a LevelDB cache adapter implementation, storing
+// the data in an embedded goleveldb database.
+//
+// Every value is stored behind a header holding the unix time at which it
+// expires, or 0. Expired values are deleted when they are read, and by the
+// GC run every Interval seconds.
+type LevelDBCacher struct {
+	cache.GetAs
+	codec     encoding.Codec
+	db        *leveldb.DB
+	prefix    []byte
+	batchSize int
+	interval  int
+	// mu serialises the writes, so that the deletion of an expired value
+	// or a counter update never overwrites a value put meanwhile.
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates and returns a new LevelDB cacher.
+func New() cache.Cache {
+	c := &LevelDBCacher{codec: cache.DefaultCodec}
+	c.GetAs = cache.GetAs{Cache: c}
+	return c
+}
+
+func (c *LevelDBCacher) SetCodec(codec encoding.Codec) {
+	c.codec = codec
+}
+
+func (c *LevelDBCacher) Codec() encoding.Codec {
+	return c.codec
+}
+
+// headerSize is the size of the expiration header of the values.
+const headerSize = 8
+
+var errCorrupt = errors.New("cache/leveldb: value too short for its header")
+
+func encodeValue(deadline int64, data []byte) []byte {
+	b := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint64(b, uint64(deadline))
+	copy(b[headerSize:], data)
+	return b
+}
+
+func decodeValue(b []byte) (deadline int64, data []byte, err error) {
+	if len(b) < headerSize {
+		return 0, nil, errCorrupt
+	}
+	return int64(binary.BigEndian.Uint64(b)), b[headerSize:], nil
+}
+
+func expired(deadline int64, now int64) bool {
+	return deadline > 0 && deadline <= now
+}
+
+func deadlineOf(expire int64) int64 {
+	if expire <= 0 {
+		return 0
+	}
+	return time.Now().Unix() + expire
+}
+
+func (c *LevelDBCacher) key(key string) []byte {
+	return append(c.prefix[:len(c.prefix):len(c.prefix)], key...)
+}
+
+// Put puts value into cache with key and expire time.
+// If expired is 0, it lives forever.
+func (c *LevelDBCacher) Put(ctx context.Context, key string, val interface{}, expire int64) error {
+	data, err := c.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Put(c.key(key), encodeValue(deadlineOf(expire), data), nil)
+}
+
+// read returns the data of key and its deadline. An expired value is
+// deleted and returned along with ErrExpired.
+func (c *LevelDBCacher) read(key []byte) (int64, []byte, error) {
+	b, err := c.db.Get(key, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			err = cache.ErrNotFound
+		}
+		return 0, nil, err
+	}
+	deadline, data, err := decodeValue(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if expired(deadline, time.Now().Unix()) {
+		if err = c.deleteExpired(key); err != nil {
+			return 0, nil, err
+		}
+		return deadline, data, cache.ErrExpired
+	}
+	return deadline, data, nil
+}
+
+// deleteExpired deletes key if its value is still an expired one.
+func (c *LevelDBCacher) deleteExpired(key []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := c.db.Get(key, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if deadline, _, err := decodeValue(b); err == nil && !expired(deadline, time.Now().Unix()) {
+		return nil
+	}
+	return c.db.Delete(key, nil)
+}
+
+// Get gets cached value by given key.
+// An expired value is still decoded into value along with ErrExpired.
+func (c *LevelDBCacher) Get(ctx context.Context, key string, value interface{}) error {
+	_, data, err := c.read(c.key(key))
+	if err != nil && err != cache.ErrExpired {
+		return err
+	}
+	if uerr := c.codec.Unmarshal(data, value); uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+// GetMulti gets the cached values of the keys of values, read from a
+// single snapshot, into the pointers they map to. The keys which are not
+// found are removed from values.
+func (c *LevelDBCacher) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	snap, err := c.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	now := time.Now().Unix()
+	for key, value := range values {
+		b, err := snap.Get(c.key(key), nil)
+		if err == leveldb.ErrNotFound {
+			delete(values, key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		deadline, data, err := decodeValue(b)
+		if err != nil {
+			return err
+		}
+		if expired(deadline, now) {
+			delete(values, key)
+			continue
+		}
+		if err = c.codec.Unmarshal(data, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutMulti puts the values into cache with the same expire time, all or
+// none of them.
+func (c *LevelDBCacher) PutMulti(ctx context.Context, values map[string]interface{}, expire int64) error {
+	deadline := deadlineOf(expire)
+	batch := new(leveldb.Batch)
+	for key, val := range values {
+		data, err := c.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		batch.Put(c.key(key), encodeValue(deadline, data))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Write(batch, nil)
+}
+
+// Delete deletes cached value by given key.
+func (c *LevelDBCacher) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Delete(c.key(key), nil)
+}
+
+// DeleteMulti deletes the cached values of keys, all or none of them.
+func (c *LevelDBCacher) DeleteMulti(ctx context.Context, keys ...string) error {
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		batch.Delete(c.key(key))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db.Write(batch, nil)
+}
+
+func (c *LevelDBCacher) update(key string, fn func(interface{}) (interface{}, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.key(key)
+	b, err := c.db.Get(k, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return cache.ErrNotFound
+		}
+		return err
+	}
+	deadline, data, err := decodeValue(b)
+	if err != nil {
+		return err
+	}
+	if expired(deadline, time.Now().Unix()) {
+		if err = c.db.Delete(k, nil); err != nil {
+			return err
+		}
+		return cache.ErrNotFound
+	}
+	var i int64
+	if err = c.codec.Unmarshal(data, &i); err != nil {
+		return err
+	}
+	val, err := fn(i)
+	if err != nil {
+		return err
+	}
+	if data, err = c.codec.Marshal(val); err != nil {
+		return err
+	}
+	return c.db.Put(k, encodeValue(deadline, data), nil)
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *LevelDBCacher) Incr(ctx context.Context, key string) error {
+	return c.update(key, cache.Incr)
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (c *LevelDBCacher) Decr(ctx context.Context, key string) error {
+	return c.update(key, cache.Decr)
+}
+
+// IsExist returns true if cached value exists and has not expired.
+func (c *LevelDBCacher) IsExist(ctx context.Context, key string) (bool, error) {
+	_, _, err := c.read(c.key(key))
+	if cache.IsDataStatusError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Scan calls fn with the keys starting with prefix, in order, skipping the
+// expired ones. It stops at the first error returned by fn.
+func (c *LevelDBCacher) Scan(ctx context.Context, prefix string, fn func(key string) error) error {
+	it := c.db.NewIterator(util.BytesPrefix(c.key(prefix)), nil)
+	defer it.Release()
+	now := time.Now().Unix()
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		deadline, _, err := decodeValue(it.Value())
+		if err != nil || expired(deadline, now) {
+			continue
+		}
+		if err = fn(string(it.Key()[len(c.prefix):])); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Flush deletes all cached data, that is every key starting with the
+// prefix.
+func (c *LevelDBCacher) Flush(ctx context.Context) error {
+	_, err := c.sweep(ctx, func([]byte) bool { return true })
+	return err
+}
+
+// GC deletes the expired values and returns how many were deleted.
+func (c *LevelDBCacher) GC(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	return c.sweep(ctx, func(value []byte) bool {
+		deadline, _, err := decodeValue(value)
+		return err != nil || expired(deadline, now)
+	})
+}
+
+// sweep deletes the keys of the cache whose value matches, batchSize keys
+// per write so that readers and writers are not held up, then compacts the
+// range it deleted from to reclaim the space of the tombstones. The scan
+// does not fill the block cache, which keeps serving the hot keys.
+func (c *LevelDBCacher) sweep(ctx context.Context, match func(value []byte) bool) (int, error) {
+	it := c.db.NewIterator(util.BytesPrefix(c.prefix), &opt.ReadOptions{DontFillCache: true})
+	defer it.Release()
+	var removed int
+	var first, last []byte
+	keys := make([][]byte, 0, c.batchSize)
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if !match(it.Value()) {
+			continue
+		}
+		key := append([]byte(nil), it.Key()...)
+		if first == nil {
+			first = key
+		}
+		last = key
+		if keys = append(keys, key); len(keys) == c.batchSize {
+			n, err := c.deleteMatching(keys, match)
+			if removed += n; err != nil {
+				return removed, err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := it.Error(); err != nil {
+		return removed, err
+	}
+	n, err := c.deleteMatching(keys, match)
+	if removed += n; err != nil || removed == 0 {
+		return removed, err
+	}
+	// Limit is exclusive.
+	return removed, c.db.CompactRange(util.Range{Start: first, Limit: append(last, 0)})
+}
+
+// deleteMatching deletes the keys whose value still matches, as a value may
+// have been put since the scan.
+func (c *LevelDBCacher) deleteMatching(keys [][]byte, match func(value []byte) bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		b, err := c.db.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if match(b) {
+			batch.Delete(key)
+		}
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	return batch.Len(), c.db.Write(batch, nil)
+}
+
+func (c *LevelDBCacher) startGC(ctx context.Context) {
+	defer c.wg.Done()
+	t := time.NewTicker(time.Duration(c.interval) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		if _, err := c.GC(ctx); err != nil && err != leveldb.ErrClosed && err != ctx.Err() {
+			log.Printf("cache/leveldb: error garbage collecting: %v", err)
+		}
+	}
+}
+
+// MemoryPath selects an in-memory database, private to the cacher. It is
+// lost on Close.
+const MemoryPath = ":memory:"
+
+// StartAndGC starts GC routine based on config string settings.
+// AdapterConfig is either the path of the database directory or key/values:
+// path=./data/cache,prefix=cache:,compression=snappy,cache_size=8388608,write_buffer=4194304,gc_batch_size=1000
+//
+// Keys are stored with the prefix, and Flush deletes only the keys starting
+// with it. compression is snappy (the default) or none; cache_size and
+// write_buffer, in bytes, size the block cache and the memtable. Expired
+// values are deleted every Interval seconds, gc_batch_size at a time.
+//
+// path=:memory: keeps the data in memory, which suits hermetic tests. Without
+// a path the database is created in <TempDir>/admpub/cache.leveldb.
+func (c *LevelDBCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
+	path := opts.AdapterConfig
+	o := &opt.Options{}
+	c.prefix = nil
+	c.batchSize = 1000
+	if strings.Contains(opts.AdapterConfig, "=") {
+		cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
+		if err != nil {
+			return err
+		}
+		path = ""
+		for k, v := range cfg.Section("").KeysHash() {
+			switch k {
+			case "path":
+				path = v
+			case "prefix":
+				c.prefix = []byte(v)
+			case "compression":
+				switch v {
+				case "snappy":
+					o.Compression = opt.SnappyCompression
+				case "none":
+					o.Compression = opt.NoCompression
+				default:
+					return fmt.Errorf("cache/leveldb: invalid compression '%s'", v)
+				}
+			case "cache_size":
+				o.BlockCacheCapacity = com.Int(v)
+			case "write_buffer":
+				o.WriteBuffer = com.Int(v)
+			case "gc_batch_size":
+				c.batchSize = com.Int(v)
+				if c.batchSize <= 0 {
+					return fmt.Errorf("cache/leveldb: invalid gc_batch_size '%s'", v)
+				}
+			default:
+				return fmt.Errorf("cache/leveldb: unsupported option '%s'", k)
+			}
+		}
+	}
+	if len(path) == 0 {
+		path = filepath.Join(os.TempDir(), `admpub/cache.leveldb`)
+	}
+
+	var err error
+	if path == MemoryPath {
+		c.db, err = leveldb.Open(storage.NewMemStorage(), o)
+	} else {
+		c.db, err = leveldb.OpenFile(path, o)
+	}
+	if err != nil {
+		return fmt.Errorf("cache/leveldb: error opening db: %v", err)
+	}
+
+	c.interval = opts.Interval
+	c.done = make(chan struct{})
+	if c.interval > 0 {
+		c.wg.Add(1)
+		go c.startGC(ctx)
+	}
+	return nil
+}
+
+func (c *LevelDBCacher) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	close(c.done)
+	c.wg.Wait()
+	err := c.db.Close()
+	c.db = nil
+	return err
+}
+
+func (c *LevelDBCacher) Client() interface{} {
+	return c.db
+}
+
+func (c *LevelDBCacher) Name() string {
+	return cacheEngineLevelDB
+}
+
+const cacheEngineLevelDB = `leveldb`
+
+func AsClient(client interface{}) *leveldb.DB {
+	return client.(*leveldb.DB)
+}
+
+func init() {
+	cache.Register(cacheEngineLevelDB, New())
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:,prefix=cache:`}))
+	defer c.Close()
+	assert.Implements(t, (*cache.Cache)(nil), c)
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+	exist, err := c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	stored, err := c.db.Get([]byte("cache:key"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, stored, headerSize+len(`"value"`))
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "missing", &value))
+	exist, err = c.IsExist(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	assert.NoError(t, c.Put(ctx, "counter", 1, 60))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, 2, c.Int(ctx, "counter"))
+	assert.Equal(t, cache.ErrNotFound, c.Incr(ctx, "missing"))
+	stored, err = c.db.Get([]byte("cache:counter"), nil)
+	assert.NoError(t, err)
+	deadline, _, err := decodeValue(stored)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Unix()+60, deadline, 1, "counters keep their expiration")
+
+	assert.NoError(t, c.Delete(ctx, "key"))
+	exist, err = c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:`}))
+	defer c.Close()
+
+	// Write already expired values.
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, c.db.Put([]byte(key), encodeValue(time.Now().Unix()-1, []byte(`"old"`)), nil))
+	}
+	assert.NoError(t, c.Put(ctx, "live", "value", 60))
+
+	var value string
+	assert.Equal(t, cache.ErrExpired, c.Get(ctx, "a", &value))
+	assert.Equal(t, "old", value, "the stale value is returned")
+	_, err := c.db.Get([]byte("a"), nil)
+	assert.Error(t, err, "deleted on read")
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "a", &value))
+	exist, err := c.IsExist(ctx, "b")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	assert.Equal(t, cache.ErrNotFound, c.Incr(ctx, "c"))
+
+	assert.NoError(t, c.db.Put([]byte("d"), encodeValue(time.Now().Unix()-1, []byte(`"old"`)), nil))
+	values := map[string]interface{}{"d": &value, "live": &value}
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Len(t, values, 1)
+	assert.Equal(t, "value", value)
+
+	removed, err := c.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, "value", c.String(ctx, "live"))
+}
+
+func TestBackgroundGC(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:,gc_batch_size=2`, Interval: 1}))
+	defer c.Close()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, c.db.Put([]byte(key), encodeValue(time.Now().Unix()-1, nil), nil))
+	}
+	assert.NoError(t, c.Put(ctx, "live", "value", 0))
+	time.Sleep(1500 * time.Millisecond)
+	var keys []string
+	it := c.db.NewIterator(nil, nil)
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Release()
+	assert.Equal(t, []string{"live"}, keys)
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+}
+
+func TestScanAndBatches(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:,prefix=cache:`}))
+	defer c.Close()
+
+	// Data of others in the same database.
+	assert.NoError(t, c.db.Put([]byte("other:user:1"), []byte("value"), nil))
+
+	assert.NoError(t, c.PutMulti(ctx, map[string]interface{}{
+		"user:2": "b",
+		"user:1": "a",
+		"user:3": "c",
+		"post:1": "p",
+	}, 0))
+	assert.NoError(t, c.db.Put([]byte("cache:user:0"), encodeValue(time.Now().Unix()-1, []byte(`"old"`)), nil))
+	var keys []string
+	scan := func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}
+	assert.NoError(t, c.Scan(ctx, "user:", scan))
+	assert.Equal(t, []string{"user:1", "user:2", "user:3"}, keys, "in order, without the expired ones")
+
+	stop := errors.New("stop")
+	keys = nil
+	assert.Equal(t, stop, c.Scan(ctx, "", func(key string) error {
+		keys = append(keys, key)
+		return stop
+	}))
+	assert.Equal(t, []string{"post:1"}, keys)
+
+	assert.NoError(t, c.DeleteMulti(ctx, "user:1", "user:2", "missing"))
+	keys = nil
+	assert.NoError(t, c.Scan(ctx, "user:", scan))
+	assert.Equal(t, []string{"user:3"}, keys)
+
+	// A value which cannot be encoded writes nothing.
+	assert.Error(t, c.PutMulti(ctx, map[string]interface{}{"ok": "value", "bad": make(chan int)}, 0))
+	exist, err := c.IsExist(ctx, "ok")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	// Flush deletes the keys of the prefix only.
+	assert.NoError(t, c.Flush(ctx))
+	keys = nil
+	assert.NoError(t, c.Scan(ctx, "", scan))
+	assert.Empty(t, keys)
+	value, err := c.db.Get([]byte("other:user:1"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestPersistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: dir}))
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	assert.NoError(t, c.Close())
+
+	c = New().(*LevelDBCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `path=` + dir + `,compression=none`}))
+	defer c.Close()
+	assert.Equal(t, "value", c.String(ctx, "key"))
+
+	err := New().StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:,compression=lz4`})
+	assert.EqualError(t, err, "cache/leveldb: invalid compression 'lz4'")
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `path=:memory:,unknown=1`})
+	assert.EqualError(t, err, "cache/leveldb: unsupported option 'unknown'")
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/admpub/cache"
+)
+
+// When chunking is enabled, values larger than an item are split into
+// chunks stored under keys of their own, and the item of the key holds a
+// manifest listing them, marked by flagChunked. Every write uses new chunk
+// keys, so that a reader never mixes the chunks of two writes; the chunks
+// of an overwritten value are left for memcached to evict.
+const (
+	// flagChunked marks an item holding a manifest. It is a whole value
+	// rather than a bit, unlikely to be used by other clients.
+	flagChunked uint32 = 0x63686e6b // "chnk"
+	// chunkKeyPrefix starts the keys of the chunks, behind the key prefix.
+	chunkKeyPrefix = "chunk:"
+	// DefaultMaxItemSize is the item size limit of memcached.
+	DefaultMaxItemSize = 1024 * 1024
+	// itemOverhead is the room left in an item for its key and header.
+	itemOverhead = 1024
+)
+
+// manifest describes the chunks of a value.
+type manifest struct {
+	id     string // random, part of the chunk keys
+	chunks int
+	size   int
+	sum    []byte // sha256 of the value
+}
+
+func (m *manifest) String() string {
+	return fmt.Sprintf("%s %d %d %x", m.id, m.chunks, m.size, m.sum)
+}
+
+func parseManifest(b []byte) (*manifest, error) {
+	m := &manifest{}
+	if _, err := fmt.Sscanf(string(b), "%s %d %d %x", &m.id, &m.chunks, &m.size, &m.sum); err != nil {
+		return nil, fmt.Errorf("cache/memcache: invalid chunk manifest: %v", err)
+	}
+	return m, nil
+}
+
+func (c *MemcacheCacher) chunkKey(id string, i int) string {
+	return c.keyPrefix + chunkKeyPrefix + id + ":" + strconv.Itoa(i)
+}
+
+func (c *MemcacheCacher) chunkKeys(m *manifest) []string {
+	keys := make([]string, m.chunks)
+	for i := range keys {
+		keys[i] = c.chunkKey(m.id, i)
+	}
+	return keys
+}
+
+// split replaces the value of item with a manifest if it does not fit in
+// an item and returns the chunks to store before it.
+func (c *MemcacheCacher) split(item *memcache.Item) ([]*memcache.Item, error) {
+	item.Flags = 0
+	size := c.maxItemSize - itemOverhead
+	if c.maxItemSize <= 0 || len(item.Value) <= size {
+		return nil, nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(item.Value)
+	m := &manifest{
+		id:     hex.EncodeToString(id),
+		chunks: (len(item.Value) + size - 1) / size,
+		size:   len(item.Value),
+		sum:    sum[:],
+	}
+	chunks := make([]*memcache.Item, m.chunks)
+	for i := range chunks {
+		end := min((i+1)*size, len(item.Value))
+		chunks[i] = NewItem(c.chunkKey(m.id, i), item.Value[i*size:end], item.Expiration)
+	}
+	item.Value = []byte(m.String())
+	item.Flags = flagChunked
+	return chunks, nil
+}
+
+// chunked reports whether item holds a manifest. Manifests are only
+// looked for when chunking is enabled.
+func (c *MemcacheCacher) chunked(item *memcache.Item) bool {
+	return c.maxItemSize > 0 && item.Flags == flagChunked
+}
+
+// join returns the value of item, reassembled from its chunks if it holds
+// a manifest. A missing chunk makes the value missing.
+func (c *MemcacheCacher) join(item *memcache.Item) ([]byte, error) {
+	if !c.chunked(item) {
+		return item.Value, nil
+	}
+	m, err := parseManifest(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	keys := c.chunkKeys(m)
+	items, err := c.c.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, m.size)
+	for _, key := range keys {
+		chunk, ok := items[key]
+		if !ok {
+			return nil, cache.ErrNotFound
+		}
+		value = append(value, chunk.Value...)
+	}
+	if sum := sha256.Sum256(value); len(value) != m.size || !bytes.Equal(sum[:], m.sum) {
+		return nil, fmt.Errorf("cache/memcache: chunks of %s do not match their manifest", item.Key)
+	}
+	return value, nil
+}
+
+// chunksOf returns the chunk keys of item, if any.
+func (c *MemcacheCacher) chunksOf(item *memcache.Item) []string {
+	if !c.chunked(item) {
+		return nil
+	}
+	m, err := parseManifest(item.Value)
+	if err != nil {
+		return nil
+	}
+	return c.chunkKeys(m)
+}
+
+// deleteChunks deletes the chunk keys, ignoring the missing ones.
+func (c *MemcacheCacher) deleteChunks(keys []string) error {
+	for _, key := range keys {
+		if err := c.c.Delete(key); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,19 +16,32 @@ package cache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/webx-top/com"
 
 	"github.com/admpub/cache"
 	"github.com/admpub/cache/encoding"
+	"github.com/admpub/ini"
 )
 
 // MemcacheCacher represents a memcache cache adapter implementation.
+//
+// The client of memcached has no context support: an operation whose
+// context ends returns the context error at once, but completes in the
+// background within the timeout of the client. A write reported as
+// cancelled may therefore still be applied.
 type MemcacheCacher struct {
 	cache.GetAs
-	codec encoding.Codec
-	c     *memcache.Client
+	codec       encoding.Codec
+	c           *memcache.Client
+	keyPrefix   string
+	maxItemSize int // 0 disables chunking
 }
 
 func NewItem(key string, data []byte, expire int32) *memcache.Item {
@@ -39,6 +52,86 @@ func NewItem(key string, data []byte, expire int32) *memcache.Item {
 	}
 }
 
+// maxRelativeExpire is the longest expiration memcached takes as a number
+// of seconds; longer ones are taken as a unix time.
+const maxRelativeExpire = 30 * 24 * 60 * 60
+
+// expiration returns the memcached expiration of an expire in seconds.
+func expiration(expire int64) int32 {
+	if expire > maxRelativeExpire {
+		expire += time.Now().Unix()
+	}
+	return int32(expire)
+}
+
+// maxKeyLength is the longest key memcached accepts.
+const maxKeyLength = 250
+
+// hashedKeyPrefix starts the keys replaced by their hash. The keys
+// starting with it or with chunkKeyPrefix are hashed too, so that they
+// cannot collide with a hashed key or a chunk.
+const hashedKeyPrefix = "sha256:"
+
+// legalKey reports whether memcached accepts key, which must be short and
+// free of spaces and control characters.
+func legalKey(key string) bool {
+	if len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the memcached key of key: key behind the key prefix, or its
+// hash if memcached would reject it or if it starts with a reserved prefix.
+func (c *MemcacheCacher) key(key string) string {
+	if k := c.keyPrefix + key; legalKey(k) && !strings.HasPrefix(key, hashedKeyPrefix) && !strings.HasPrefix(key, chunkKeyPrefix) {
+		return k
+	}
+	sum := sha256.Sum256([]byte(key))
+	return c.keyPrefix + hashedKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// convertError translates the errors of gomemcache to the cache errors.
+func convertError(err error) error {
+	switch err {
+	case memcache.ErrCacheMiss:
+		return cache.ErrNotFound
+	case memcache.ErrNotStored:
+		return cache.ErrNotStored
+	case memcache.ErrCASConflict:
+		return cache.ErrCASConflict
+	default:
+		return err
+	}
+}
+
+// do runs fn, returning as soon as ctx is done. gomemcache has no context
+// support, and its Timeout is shared by every call, so fn then completes
+// in the background within that Timeout, and its writes may apply.
+func do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return convertError(fn())
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return convertError(err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *MemcacheCacher) SetCodec(codec encoding.Codec) {
 	c.codec = codec
 }
@@ -47,52 +140,227 @@ func (c *MemcacheCacher) Codec() encoding.Codec {
 	return c.codec
 }
 
+// store encodes val into item and writes it with write, which is one of
+// the storage commands of the client, after the chunks of a large value.
+func (c *MemcacheCacher) store(ctx context.Context, item *memcache.Item, val interface{}, write func(*memcache.Item) error) error {
+	value, err := c.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	item.Value = value
+	return do(ctx, func() error {
+		chunks, err := c.split(item)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			if err = c.c.Set(chunk); err != nil {
+				return err
+			}
+			keys[i] = chunk.Key
+		}
+		if err = write(item); err != nil && len(keys) > 0 {
+			// A conditional write which did not apply.
+			c.deleteChunks(keys)
+		}
+		return err
+	})
+}
+
 // Put puts value into cache with key and expire time.
 // If expired is 0, it lives forever.
 func (c *MemcacheCacher) Put(ctx context.Context, key string, val interface{}, expire int64) error {
-	value, err := c.codec.Marshal(val)
+	return c.store(ctx, NewItem(c.key(key), nil, expiration(expire)), val, c.c.Set)
+}
+
+// Add puts value into cache only if key does not exist yet, and returns
+// cache.ErrNotStored otherwise.
+func (c *MemcacheCacher) Add(ctx context.Context, key string, val interface{}, expire int64) error {
+	return c.store(ctx, NewItem(c.key(key), nil, expiration(expire)), val, c.c.Add)
+}
+
+// Replace puts value into cache only if key exists, and returns
+// cache.ErrNotStored otherwise.
+func (c *MemcacheCacher) Replace(ctx context.Context, key string, val interface{}, expire int64) error {
+	return c.store(ctx, NewItem(c.key(key), nil, expiration(expire)), val, c.c.Replace)
+}
+
+// get returns the item of key along with its value, reassembled from its
+// chunks if need be.
+func (c *MemcacheCacher) get(ctx context.Context, key string) (*memcache.Item, []byte, error) {
+	var item *memcache.Item
+	var value []byte
+	err := do(ctx, func() (err error) {
+		if item, err = c.c.Get(c.key(key)); err != nil {
+			return
+		}
+		value, err = c.join(item)
+		return
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	item := NewItem(key, value, int32(expire))
-	err = c.c.Set(item)
-	return err
+	if value == nil {
+		return nil, nil, cache.ErrNotFound
+	}
+	return item, value, nil
 }
 
 // Get gets cached value by given key.
 func (c *MemcacheCacher) Get(ctx context.Context, key string, value interface{}) error {
-	item, err := c.c.Get(key)
+	_, data, err := c.get(ctx, key)
 	if err != nil {
 		return err
 	}
-	if item == nil || item.Value == nil {
-		return cache.ErrNotFound
+	return c.codec.Unmarshal(data, value)
+}
+
+// GetMulti gets the cached values of several keys in one round trip per
+// server. values maps each key to the pointer its value is decoded into;
+// the keys which are not found are removed from values.
+func (c *MemcacheCacher) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, c.key(key))
+	}
+	var data map[string][]byte
+	err := do(ctx, func() error {
+		items, err := c.c.GetMulti(keys)
+		if err != nil {
+			return err
+		}
+		data = make(map[string][]byte, len(items))
+		for key, item := range items {
+			value, err := c.join(item)
+			if err != nil && err != cache.ErrNotFound {
+				return err
+			}
+			data[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		b := data[c.key(key)]
+		if b == nil {
+			delete(values, key)
+			continue
+		}
+		if err = c.codec.Unmarshal(b, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CASItem is a cached value read by Gets, holding the version which
+// CompareAndSwap checks.
+type CASItem struct {
+	key  string
+	item *memcache.Item
+}
+
+// Key returns the key of the value.
+func (i *CASItem) Key() string {
+	return i.key
+}
+
+// Gets gets cached value by given key like Get, along with its version for
+// CompareAndSwap.
+func (c *MemcacheCacher) Gets(ctx context.Context, key string, value interface{}) (*CASItem, error) {
+	item, data, err := c.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.codec.Unmarshal(data, value); err != nil {
+		return nil, err
 	}
-	return c.codec.Unmarshal(item.Value, value)
+	return &CASItem{key: key, item: item}, nil
+}
+
+// CompareAndSwap replaces the value read by Gets with val unless it was
+// modified or deleted since, returning cache.ErrCASConflict or
+// cache.ErrNotFound respectively.
+func (c *MemcacheCacher) CompareAndSwap(ctx context.Context, item *CASItem, val interface{}, expire int64) error {
+	// The copy keeps the version of item and leaves item reusable.
+	cas := *item.item
+	cas.Expiration = expiration(expire)
+	return c.store(ctx, &cas, val, c.c.CompareAndSwap)
 }
 
-// Delete deletes cached value by given key.
+// Touch sets a new expire time of the cached value by given key.
+// The chunks of a large value are touched as well.
+func (c *MemcacheCacher) Touch(ctx context.Context, key string, expire int64) error {
+	exp := expiration(expire)
+	return do(ctx, func() error {
+		if c.maxItemSize <= 0 {
+			return c.c.Touch(c.key(key), exp)
+		}
+		item, err := c.c.GetAndTouch(c.key(key), exp)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range c.chunksOf(item) {
+			if err = c.c.Touch(chunk, exp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes cached value by given key, along with the chunks of a
+// large value. Deleting a missing key is not an error.
 func (c *MemcacheCacher) Delete(ctx context.Context, key string) error {
-	return c.c.Delete(key)
+	return do(ctx, func() error {
+		if c.maxItemSize > 0 {
+			item, err := c.c.Get(c.key(key))
+			if err != nil {
+				if err == memcache.ErrCacheMiss {
+					return nil
+				}
+				return err
+			}
+			if err = c.deleteChunks(c.chunksOf(item)); err != nil {
+				return err
+			}
+		}
+		if err := c.c.Delete(c.key(key)); err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	})
 }
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *MemcacheCacher) Incr(ctx context.Context, key string) error {
-	_, err := c.c.Increment(key, 1)
-	return err
+	return do(ctx, func() error {
+		_, err := c.c.Increment(c.key(key), 1)
+		return err
+	})
 }
 
 // Decr decreases cached int-type value by given key as a counter.
+// memcached does not decrease a counter below 0.
 func (c *MemcacheCacher) Decr(ctx context.Context, key string) error {
-	_, err := c.c.Decrement(key, 1)
-	return err
+	return do(ctx, func() error {
+		_, err := c.c.Decrement(c.key(key), 1)
+		return err
+	})
 }
 
 // IsExist returns true if cached value exists.
+// The chunks of a large value are not checked.
 func (c *MemcacheCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	_, err := c.c.Get(key)
+	err := do(ctx, func() error {
+		_, err := c.c.Get(c.key(key))
+		return err
+	})
 	if err != nil {
-		if err == memcache.ErrCacheMiss {
+		if err == cache.ErrNotFound {
 			return false, nil
 		}
 		return false, err
@@ -102,13 +370,69 @@ func (c *MemcacheCacher) IsExist(ctx context.Context, key string) (bool, error)
 
 // Flush deletes all cached data.
 func (c *MemcacheCacher) Flush(ctx context.Context) error {
-	return c.c.FlushAll()
+	return do(ctx, c.c.FlushAll)
 }
 
 // StartAndGC starts GC routine based on config string settings.
 // AdapterConfig: 127.0.0.1:9090;127.0.0.1:9091
+// or, to set options as well:
+// addr=127.0.0.1:9090|127.0.0.1:9091,timeout=0.5,max_idle_conns=10,key_prefix=app:
+//
+// timeout is the socket read/write timeout in seconds (0.5 by default),
+// which also bounds the operations left running in the background when
+// their context is done. max_idle_conns is the number of idle connections
+// kept per server (2 by default).
+//
+// Keys are put behind key_prefix; keys memcached would reject, because
+// they are longer than 250 bytes or contain spaces or control characters,
+// are replaced by their SHA-256, as are the keys starting with "sha256:"
+// or "chunk:". max_item_size, the item size limit of the server in bytes
+// (usually 1048576), enables chunking: larger values are split into
+// several items and reassembled by Get. It is off by default, as Delete
+// then needs to read the value first.
 func (c *MemcacheCacher) StartAndGC(ctx context.Context, opt cache.Options) error {
-	c.c = memcache.New(strings.Split(opt.AdapterConfig, ";")...)
+	c.keyPrefix = ""
+	c.maxItemSize = 0
+	if !strings.Contains(opt.AdapterConfig, "=") {
+		c.c = memcache.New(strings.Split(opt.AdapterConfig, ";")...)
+		return nil
+	}
+
+	cfg, err := ini.Load([]byte(strings.Replace(opt.AdapterConfig, ",", "\n", -1)))
+	if err != nil {
+		return err
+	}
+	var addrs []string
+	var timeout time.Duration
+	var maxIdleConns int
+	for k, v := range cfg.Section("").KeysHash() {
+		switch k {
+		case "addr":
+			addrs = strings.Split(v, "|")
+		case "timeout":
+			timeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing timeout: %v", err)
+			}
+		case "max_idle_conns":
+			maxIdleConns = com.Int(v)
+		case "key_prefix":
+			c.keyPrefix = v
+		case "max_item_size":
+			c.maxItemSize = com.Int(v)
+		default:
+			return fmt.Errorf("cache/memcache: unsupported option '%s'", k)
+		}
+	}
+	if !legalKey(c.keyPrefix + hashedKeyPrefix + strings.Repeat("0", sha256.Size*2)) {
+		return fmt.Errorf("cache/memcache: invalid key_prefix '%s'", c.keyPrefix)
+	}
+	if c.maxItemSize != 0 && c.maxItemSize <= itemOverhead {
+		return fmt.Errorf("cache/memcache: max_item_size must be 0 or over %d", itemOverhead)
+	}
+	c.c = memcache.New(addrs...)
+	c.c.Timeout = timeout
+	c.c.MaxIdleConns = maxIdleConns
 	return nil
 }
 
@@ -116,7 +440,7 @@ func (c *MemcacheCacher) Close() error {
 	if c.c == nil {
 		return nil
 	}
-	return nil
+	return c.c.Close()
 }
 
 func (c *MemcacheCacher) Client() interface{} {
@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+)
+
+func TestCache(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: s.Addr()}))
+	defer c.Close()
+	assert.Implements(t, (*cache.Cache)(nil), c)
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+	exist, err := c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "missing", &value))
+	exist, err = c.IsExist(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	assert.NoError(t, c.Put(ctx, "counter", 1, 0))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.Equal(t, 2, c.Int(ctx, "counter"))
+	assert.Equal(t, cache.ErrNotFound, c.Incr(ctx, "missing"))
+
+	assert.NoError(t, c.Delete(ctx, "key"))
+	assert.NoError(t, c.Delete(ctx, "key"), "a missing key is already deleted")
+	assert.NoError(t, c.Flush(ctx))
+	assert.Empty(t, s.Keys())
+
+	// Expirations over 30 days are sent as a unix time.
+	assert.NoError(t, c.Put(ctx, "long", "value", 60*24*60*60))
+	assert.InDelta(t, 60*24*time.Hour, s.TTL("long"), float64(2*time.Second))
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: s.Addr()}))
+	defer c.Close()
+
+	assert.NoError(t, c.Add(ctx, "key", "first", 0))
+	assert.Equal(t, cache.ErrNotStored, c.Add(ctx, "key", "second", 0))
+	assert.NoError(t, c.Replace(ctx, "key", "third", 0))
+	assert.Equal(t, cache.ErrNotStored, c.Replace(ctx, "missing", "value", 0))
+	assert.Equal(t, "third", c.String(ctx, "key"))
+
+	var value string
+	item, err := c.Gets(ctx, "key", &value)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", item.Key())
+	assert.Equal(t, "third", value)
+	assert.NoError(t, c.CompareAndSwap(ctx, item, "fourth", 0))
+	assert.Equal(t, cache.ErrCASConflict, c.CompareAndSwap(ctx, item, "fifth", 0))
+	assert.Equal(t, "fourth", c.String(ctx, "key"))
+	item, err = c.Gets(ctx, "key", &value)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Delete(ctx, "key"))
+	assert.Equal(t, cache.ErrNotFound, c.CompareAndSwap(ctx, item, "sixth", 0))
+	_, err = c.Gets(ctx, "key", &value)
+	assert.Equal(t, cache.ErrNotFound, err)
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 60))
+	assert.NoError(t, c.Touch(ctx, "key", 3600))
+	assert.Equal(t, time.Hour, s.TTL("key"))
+	assert.Equal(t, cache.ErrNotFound, c.Touch(ctx, "missing", 60))
+}
+
+func TestGetMulti(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: s.Addr()}))
+	defer c.Close()
+
+	assert.NoError(t, c.Put(ctx, "a", "first", 0))
+	assert.NoError(t, c.Put(ctx, "b", 2, 0))
+	var a, missing string
+	var b int
+	values := map[string]interface{}{"a": &a, "b": &b, "missing": &missing}
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Equal(t, "first", a)
+	assert.Equal(t, 2, b)
+	assert.Len(t, values, 2)
+	assert.NotContains(t, values, "missing")
+}
+
+func TestContextAndOptions(t *testing.T) {
+	s := newFakeServer(t)
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(context.Background(), cache.Options{AdapterConfig: `addr=` + s.Addr() + `,timeout=2,max_idle_conns=5`}))
+	defer c.Close()
+	assert.Equal(t, 2*time.Second, c.c.Timeout)
+	assert.Equal(t, 5, c.c.MaxIdleConns)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, c.Put(ctx, "key", "value", 0))
+	assert.Empty(t, s.Keys(), "nothing is sent once the context is done")
+
+	s.setDelay(500 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var value string
+	assert.Equal(t, context.DeadlineExceeded, c.Get(ctx, "key", &value))
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+
+	err := New().StartAndGC(context.Background(), cache.Options{AdapterConfig: `addr=` + s.Addr() + `,timeout=soon`})
+	assert.Error(t, err)
+	err = New().StartAndGC(context.Background(), cache.Options{AdapterConfig: `addr=` + s.Addr() + `,unknown=1`})
+	assert.EqualError(t, err, "cache/memcache: unsupported option 'unknown'")
+}
+
+func TestKeyNormalisation(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,key_prefix=app:`}))
+	defer c.Close()
+
+	long := strings.Repeat("k", 300)
+	for _, key := range []string{"plain", "with space", "line\nbreak", long} {
+		assert.NoError(t, c.Put(ctx, key, key, 0))
+		assert.Equal(t, key, c.String(ctx, key))
+		exist, err := c.IsExist(ctx, key)
+		assert.NoError(t, err)
+		assert.True(t, exist)
+	}
+	sum := sha256.Sum256([]byte(long))
+	assert.NotNil(t, s.Get("app:plain"))
+	assert.NotNil(t, s.Get("app:sha256:"+hex.EncodeToString(sum[:])))
+	for _, key := range s.Keys() {
+		assert.True(t, strings.HasPrefix(key, "app:"))
+		assert.True(t, legalKey(key), key)
+	}
+
+	var a, b string
+	values := map[string]interface{}{"plain": &a, long: &b}
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Equal(t, long, b)
+	item, err := c.Gets(ctx, long, &b)
+	assert.NoError(t, err)
+	assert.Equal(t, long, item.Key())
+	assert.NoError(t, c.Delete(ctx, long))
+	assert.Len(t, s.Keys(), 3)
+
+	// The keys of the reserved namespaces are hashed as well.
+	for _, key := range []string{"sha256:" + hex.EncodeToString(sum[:]), "chunk:0:0"} {
+		assert.NoError(t, c.Put(ctx, key, key, 0))
+		assert.Nil(t, s.Get("app:"+key))
+		assert.Equal(t, key, c.String(ctx, key))
+	}
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, long, &b))
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,key_prefix=bad prefix`})
+	assert.Error(t, err)
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,key_prefix=` + strings.Repeat("p", 200)})
+	assert.Error(t, err)
+}
+
+func TestChunking(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+	c := New().(*MemcacheCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,key_prefix=app:,max_item_size=1048576`}))
+	defer c.Close()
+
+	large := bytes.Repeat([]byte("0123456789"), 250000) // 2.5 MB
+	assert.NoError(t, c.Put(ctx, "large", large, 3600))
+	keys := s.Keys()
+	sort.Strings(keys)
+	// JSON encodes the bytes in base64, into 3.3 MB.
+	assert.Len(t, keys, 5, "four chunks and a manifest")
+	assert.Equal(t, "app:large", keys[4])
+	for _, key := range keys[:4] {
+		assert.True(t, strings.HasPrefix(key, "app:chunk:"), key)
+		assert.LessOrEqual(t, len(s.Get(key)), maxItemSize)
+		assert.Equal(t, time.Hour, s.TTL(key))
+	}
+	var value []byte
+	assert.NoError(t, c.Get(ctx, "large", &value))
+	assert.Equal(t, large, value)
+
+	values := map[string]interface{}{"large": &value}
+	value = nil
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Equal(t, large, value)
+
+	// Touch and compare-and-swap carry the chunks along.
+	assert.NoError(t, c.Touch(ctx, "large", 7200))
+	for _, key := range keys {
+		assert.Equal(t, 2*time.Hour, s.TTL(key))
+	}
+	item, err := c.Gets(ctx, "large", &value)
+	assert.NoError(t, err)
+	larger := append(large, large...)
+	assert.NoError(t, c.CompareAndSwap(ctx, item, larger, 0))
+	assert.Equal(t, cache.ErrCASConflict, c.CompareAndSwap(ctx, item, large, 0))
+	assert.NoError(t, c.Get(ctx, "large", &value))
+	assert.Equal(t, larger, value)
+
+	// A conditional write which fails leaves no chunks behind.
+	n := len(s.Keys())
+	assert.Equal(t, cache.ErrNotStored, c.Add(ctx, "large", large, 0))
+	assert.Len(t, s.Keys(), n)
+
+	// Delete removes the chunks.
+	assert.NoError(t, c.Put(ctx, "small", "value", 0))
+	assert.NoError(t, c.Flush(ctx))
+	assert.NoError(t, c.Put(ctx, "large", large, 0))
+	assert.NoError(t, c.Delete(ctx, "large"))
+	assert.Empty(t, s.Keys())
+	assert.NoError(t, c.Delete(ctx, "large"), "a missing key is already deleted")
+
+	// A lost or altered chunk is detected.
+	assert.NoError(t, c.Put(ctx, "large", large, 0))
+	var chunk string
+	for _, key := range s.Keys() {
+		if strings.HasPrefix(key, "app:chunk:") {
+			chunk = key
+		}
+	}
+	s.Set(chunk, []byte("altered"))
+	assert.Error(t, c.Get(ctx, "large", &value))
+	s.Delete(chunk)
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "large", &value))
+	values = map[string]interface{}{"large": &value}
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Empty(t, values)
+
+	// Chunking is off by default: the server refuses the value, and the
+	// flags of the items are not looked at.
+	plain := New().(*MemcacheCacher)
+	assert.NoError(t, plain.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,key_prefix=app:`}))
+	defer plain.Close()
+	assert.Error(t, plain.Put(ctx, "large", large, 0))
+	assert.NoError(t, plain.c.Set(&memcache.Item{Key: "app:foreign", Value: []byte(`"value"`), Flags: flagChunked}))
+	assert.Equal(t, "value", plain.String(ctx, "foreign"))
+	// Other clients' flags are not taken for a manifest.
+	assert.NoError(t, c.c.Set(&memcache.Item{Key: "app:flagged", Value: []byte(`"value"`), Flags: 1}))
+	assert.Equal(t, "value", c.String(ctx, "flagged"))
+}
@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// maxItemSize is the default item size limit of memcached.
+const maxItemSize = 1024 * 1024
+
+type fakeItem struct {
+	value    []byte
+	flags    uint32
+	cas      uint64
+	deadline time.Time
+}
+
+// fakeServer is an in-memory server speaking the memcached text protocol
+// commands which gomemcache sends.
+type fakeServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	items map[string]*fakeItem
+	cas   uint64
+	delay time.Duration // before each reply
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, items: map[string]*fakeItem{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) setDelay(d time.Duration) {
+	s.mu.Lock()
+	s.delay = d
+	s.mu.Unlock()
+}
+
+// item returns the live item of key. s.mu must be held.
+func (s *fakeServer) item(key string) *fakeItem {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.deadline.IsZero() && !time.Now().Before(it.deadline) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+// Keys returns the keys of the live items.
+func (s *fakeServer) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.items {
+		if s.item(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Get returns the value of key, bypassing the protocol.
+func (s *fakeServer) Get(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it := s.item(key); it != nil {
+		return it.value
+	}
+	return nil
+}
+
+// Delete deletes key, bypassing the protocol.
+func (s *fakeServer) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+// Set stores value under key, bypassing the protocol.
+func (s *fakeServer) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cas++
+	s.items[key] = &fakeItem{value: value, cas: s.cas}
+}
+
+// TTL returns the time left before key expires.
+func (s *fakeServer) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it := s.item(key); it != nil && !it.deadline.IsZero() {
+		return time.Until(it.deadline).Round(time.Second)
+	}
+	return 0
+}
+
+func deadline(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime <= 30*24*60*60:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		var data []byte
+		switch args[0] {
+		case "set", "add", "replace", "cas":
+			if len(args) < 5 {
+				return
+			}
+			n, _ := strconv.Atoi(args[4])
+			data = make([]byte, n+2)
+			if _, err = io.ReadFull(rw, data); err != nil {
+				return
+			}
+			data = data[:n]
+		}
+		s.mu.Lock()
+		delay := s.delay
+		reply := s.exec(args, data)
+		s.mu.Unlock()
+		time.Sleep(delay)
+		rw.WriteString(reply)
+		if err = rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command with s.mu held and returns the reply.
+func (s *fakeServer) exec(args []string, data []byte) string {
+	for _, key := range args[1:] {
+		if len(key) > 250 {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+	}
+	switch args[0] {
+	case "get", "gets":
+		var b strings.Builder
+		for _, key := range args[1:] {
+			if it := s.item(key); it != nil {
+				fmt.Fprintf(&b, "VALUE %s %d %d %d\r\n%s\r\n", key, it.flags, len(it.value), it.cas, it.value)
+			}
+		}
+		return b.String() + "END\r\n"
+	case "set", "add", "replace", "cas":
+		if len(data) > maxItemSize {
+			return "SERVER_ERROR object too large for cache\r\n"
+		}
+		key := args[1]
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exptime, _ := strconv.ParseInt(args[3], 10, 64)
+		it := s.item(key)
+		switch {
+		case args[0] == "add" && it != nil, args[0] == "replace" && it == nil:
+			return "NOT_STORED\r\n"
+		case args[0] == "cas" && it == nil:
+			return "NOT_FOUND\r\n"
+		case args[0] == "cas" && len(args) > 5 && args[5] != strconv.FormatUint(it.cas, 10):
+			return "EXISTS\r\n"
+		}
+		s.cas++
+		s.items[key] = &fakeItem{value: data, flags: uint32(flags), cas: s.cas, deadline: deadline(exptime)}
+		return "STORED\r\n"
+	case "delete":
+		if s.item(args[1]) == nil {
+			return "NOT_FOUND\r\n"
+		}
+		delete(s.items, args[1])
+		return "DELETED\r\n"
+	case "incr", "decr":
+		it := s.item(args[1])
+		if it == nil {
+			return "NOT_FOUND\r\n"
+		}
+		n, err := strconv.ParseUint(string(it.value), 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"
+		}
+		delta, _ := strconv.ParseUint(args[2], 10, 64)
+		if args[0] == "incr" {
+			n += delta
+		} else if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+		s.cas++
+		it.value, it.cas = []byte(strconv.FormatUint(n, 10)), s.cas
+		return string(it.value) + "\r\n"
+	case "gat":
+		exptime, _ := strconv.ParseInt(args[1], 10, 64)
+		var b strings.Builder
+		for _, key := range args[2:] {
+			if it := s.item(key); it != nil {
+				it.deadline = deadline(exptime)
+				fmt.Fprintf(&b, "VALUE %s %d %d\r\n%s\r\n", key, it.flags, len(it.value), it.value)
+			}
+		}
+		return b.String() + "END\r\n"
+	case "touch":
+		it := s.item(args[1])
+		if it == nil {
+			return "NOT_FOUND\r\n"
+		}
+		exptime, _ := strconv.ParseInt(args[2], 10, 64)
+		it.deadline = deadline(exptime)
+		return "TOUCHED\r\n"
+	case "flush_all":
+		s.items = map[string]*fakeItem{}
+		return "OK\r\n"
+	case "version":
+		return "VERSION 1.6.0\r\n"
+	}
+	return "ERROR\r\n"
+}
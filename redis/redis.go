@@ -25,6 +25,7 @@ import (
 
 	"github.com/admpub/cache"
 	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/internal/tlsconfig"
 	"github.com/admpub/ini"
 )
 
@@ -32,13 +33,30 @@ import (
 type RedisCacher struct {
 	cache.GetAs
 	codec      encoding.Codec
-	c          *redis.Client
-	options    *redis.Options
+	c          redis.UniversalClient
+	options    *redis.UniversalOptions
+	network    string // network of a single node, e.g. unix
+	cluster    bool
 	prefix     string
 	hsetName   string
+	flushMode  string
 	occupyMode bool
 }
 
+// Flush modes, selecting how Flush finds the keys of the cache when the
+// database is shared (OccupyMode is false).
+const (
+	// FlushModeHSet records every key in the hset_name hash.
+	FlushModeHSet = "hset"
+	// FlushModeScan finds the keys by scanning for the prefix.
+	FlushModeScan = "scan"
+)
+
+// registry reports whether keys are recorded in the hset_name hash.
+func (c *RedisCacher) registry() bool {
+	return !c.occupyMode && c.flushMode != FlushModeScan
+}
+
 func (c *RedisCacher) SetCodec(codec encoding.Codec) {
 	c.codec = codec
 }
@@ -58,7 +76,7 @@ func (c *RedisCacher) Put(ctx context.Context, key string, val interface{}, expi
 	if err := c.c.Set(ctx, key, com.Bytes2str(value), time.Duration(expire)*time.Second).Err(); err != nil {
 		return err
 	}
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HSet(ctx, c.hsetName, key, "0").Err()
@@ -87,7 +105,7 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 		return err
 	}
 
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HDel(ctx, c.hsetName, key).Err()
@@ -95,34 +113,42 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *RedisCacher) Incr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("key '%s' not exist", key)
-	}
-	return c.c.Incr(ctx, c.prefix+key).Err()
+	return c.incrBy(ctx, key, 1)
 }
 
 // Decr decreases cached int-type value by given key as a counter.
 func (c *RedisCacher) Decr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
+	return c.incrBy(ctx, key, -1)
+}
+
+// counterScript adds ARGV[1] to the integer stored at KEYS[1] and returns
+// nil if the key does not exist, so that a counter which expired is not
+// recreated without its TTL. INCRBY itself keeps the TTL.
+var counterScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`)
+
+// incrBy atomically adds n to the counter stored under key.
+func (c *RedisCacher) incrBy(ctx context.Context, key string, n int64) error {
+	err := counterScript.Run(ctx, c.c, []string{c.prefix + key}, n).Err()
+	if err == redis.Nil {
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	return c.c.Decr(ctx, c.prefix+key).Err()
+	return err
 }
 
 // IsExist returns true if cached value exists.
 func (c *RedisCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	if c.c.Exists(ctx, c.prefix+key).Val() > 0 {
-		return true, nil
+	n, err := c.c.Exists(ctx, c.prefix+key).Result()
+	if err != nil || n > 0 {
+		return n > 0, err
 	}
 
-	if !c.occupyMode {
-		c.c.HDel(ctx, c.hsetName, c.prefix+key)
+	if c.registry() {
+		return false, c.c.HDel(ctx, c.hsetName, c.prefix+key).Err()
 	}
 	return false, nil
 }
@@ -130,67 +156,289 @@ func (c *RedisCacher) IsExist(ctx context.Context, key string) (bool, error) {
 // Flush deletes all cached data.
 func (c *RedisCacher) Flush(ctx context.Context) error {
 	if c.occupyMode {
-		return c.c.FlushDB(ctx).Err()
+		return c.flushDB(ctx)
+	}
+	if c.flushMode == FlushModeScan {
+		return c.flushPrefix(ctx)
 	}
 
 	keys, err := c.c.HKeys(ctx, c.hsetName).Result()
 	if err != nil {
 		return err
 	}
-	if err = c.c.Del(ctx, keys...).Err(); err != nil {
+	if err = c.unlink(ctx, c.c, keys); err != nil {
 		return err
 	}
 	return c.c.Del(ctx, c.hsetName).Err()
 }
 
-// StartAndGC starts GC routine based on config string settings.
-// AdapterConfig: network=tcp,addr=:6379,password=123456,db=0,pool_size=100,idle_timeout=180,hset_name=Cache,prefix=cache:
-func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
-	c.hsetName = "Cache"
-	c.occupyMode = opts.OccupyMode
+// scanCount is the COUNT hint of the SCAN calls of Flush.
+const scanCount = 1000
+
+// flushPrefix deletes the keys starting with the prefix, scanning every
+// master of a cluster.
+func (c *RedisCacher) flushPrefix(ctx context.Context) error {
+	if cluster, ok := c.c.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return c.scanAndUnlink(ctx, master)
+		})
+	}
+	return c.scanAndUnlink(ctx, c.c)
+}
+
+func (c *RedisCacher) scanAndUnlink(ctx context.Context, client redis.Cmdable) error {
+	iter := client.Scan(ctx, 0, escapePattern(c.prefix)+"*", scanCount).Iterator()
+	keys := make([]string, 0, delBatchSize)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == delBatchSize {
+			if err := c.unlink(ctx, client, keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return c.unlink(ctx, client, keys)
+}
+
+// escapePattern escapes the glob characters of a SCAN MATCH pattern.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// flushDB empties the database, on every master of a cluster.
+func (c *RedisCacher) flushDB(ctx context.Context) error {
+	if cluster, ok := c.c.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return master.FlushDB(ctx).Err()
+		})
+	}
+	return c.c.FlushDB(ctx).Err()
+}
+
+// delBatchSize bounds the number of keys deleted per round trip.
+const delBatchSize = 500
+
+// unlink deletes keys in batches, reclaiming their memory in the
+// background. Keys of a cluster may live in different hash slots, so they
+// are deleted one by one in a pipeline, which the cluster client routes to
+// the owning nodes.
+func (c *RedisCacher) unlink(ctx context.Context, client redis.Cmdable, keys []string) error {
+	for len(keys) > 0 {
+		n := delBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		if !c.cluster {
+			if err := client.Unlink(ctx, batch...).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range batch {
+				pipe.Unlink(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
+// parseConfig reads the AdapterConfig settings into c.
+func (c *RedisCacher) parseConfig(config string) error {
+	cfg, err := ini.Load([]byte(strings.Replace(config, ",", "\n", -1)))
 	if err != nil {
 		return err
 	}
 
-	c.options = &redis.Options{
-		Network: "tcp",
+	c.options = &redis.UniversalOptions{}
+	c.cluster = false
+	c.network = "tcp"
+	c.flushMode = FlushModeHSet
+	var tlsOptions tlsconfig.Options
+	keys := cfg.Section("").KeysHash()
+	if _, ok := keys["addrs"]; ok {
+		if _, ok = keys["addr"]; ok {
+			return fmt.Errorf("cache/redis: addr and addrs are mutually exclusive")
+		}
 	}
-	for k, v := range cfg.Section("").KeysHash() {
+	for k, v := range keys {
 		switch k {
 		case "network":
-			c.options.Network = v
+			c.network = v
 		case "addr":
-			c.options.Addr = v
+			c.options.Addrs = []string{v}
+		case "addrs":
+			c.options.Addrs = strings.Split(v, "|")
+		case "cluster":
+			c.cluster = com.Bool(v)
+		case "master_name":
+			c.options.MasterName = v
+		case "sentinel_password":
+			c.options.SentinelPassword = v
+		case "route_by_latency":
+			c.options.RouteByLatency = com.Bool(v)
+		case "read_only":
+			c.options.ReadOnly = com.Bool(v)
+		case "username":
+			c.options.Username = v
 		case "password":
 			c.options.Password = v
 		case "db":
 			c.options.DB = com.Int(v)
 		case "pool_size":
 			c.options.PoolSize = com.Int(v)
+		case "min_idle_conns":
+			c.options.MinIdleConns = com.Int(v)
+		case "max_retries":
+			c.options.MaxRetries = com.Int(v)
 		case "idle_timeout":
 			c.options.IdleTimeout, err = time.ParseDuration(v + "s")
 			if err != nil {
 				return fmt.Errorf("error parsing idle timeout: %v", err)
 			}
+		case "dial_timeout":
+			c.options.DialTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing dial timeout: %v", err)
+			}
+		case "read_timeout":
+			c.options.ReadTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing read timeout: %v", err)
+			}
+		case "write_timeout":
+			c.options.WriteTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing write timeout: %v", err)
+			}
 		case "hset_name":
 			c.hsetName = v
+		case "flush_mode":
+			if v != FlushModeHSet && v != FlushModeScan {
+				return fmt.Errorf("cache/redis: invalid flush_mode '%s'", v)
+			}
+			c.flushMode = v
 		case "prefix":
 			c.prefix = v
 		default:
-			return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			if !tlsOptions.Set(k, v) {
+				return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			}
 		}
 	}
+	if c.options.TLSConfig, err = tlsOptions.Config(); err != nil {
+		return fmt.Errorf("cache/redis: %v", err)
+	}
+	if len(c.options.MasterName) > 0 {
+		if c.cluster {
+			return fmt.Errorf("cache/redis: master_name and cluster are mutually exclusive")
+		}
+	} else if len(c.options.Addrs) > 1 {
+		c.cluster = true
+	}
+	return nil
+}
 
-	c.c = redis.NewClient(c.options)
-	if err = c.c.Ping(ctx).Err(); err != nil {
+// StartAndGC starts GC routine based on config string settings.
+// AdapterConfig: network=tcp,addr=:6379,password=123456,db=0,pool_size=100,idle_timeout=180,hset_name=Cache,prefix=cache:
+//
+// A Sentinel-managed master is selected with master_name and the sentinel
+// addresses, e.g. addrs=10.0.0.1:26379|10.0.0.2:26379,master_name=mymaster,sentinel_password=secret
+// A cluster is reached through several seed addresses, or through a single
+// one with cluster=true; route_by_latency and read_only allow read commands
+// to be served by replicas.
+//
+// username selects an ACL user. Timeouts are in seconds: dial_timeout,
+// read_timeout and write_timeout; min_idle_conns keeps idle connections in
+// the pool. tls=true encrypts connections, which tls_ca_file, tls_cert_file,
+// tls_key_file, tls_server_name and tls_insecure_skip_verify configure, e.g.
+// addr=redis.internal:6380,username=app,password=secret,tls_ca_file=/etc/redis/ca.pem,dial_timeout=2.5
+//
+// max_retries is the number of retries of a failed command: 0 keeps the
+// default of the client library and -1 disables retries.
+//
+// flush_mode=scan stops recording keys in the hset_name hash, which grows
+// with every key put, and makes Flush scan for the keys starting with the
+// prefix instead; the prefix is then required. The keys of the prefix that
+// the default flush_mode=hset recorded in the hash are removed on start.
+func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
+	c.hsetName = "Cache"
+	c.occupyMode = opts.OccupyMode
+
+	if err := c.parseConfig(opts.AdapterConfig); err != nil {
 		return err
 	}
+	migrate := c.flushMode == FlushModeScan && !c.occupyMode
+	if migrate && len(c.prefix) == 0 {
+		return fmt.Errorf("cache/redis: flush_mode=scan requires a prefix")
+	}
 
+	switch {
+	case c.cluster:
+		c.c = redis.NewClusterClient(c.options.Cluster())
+	case len(c.options.MasterName) > 0:
+		c.c = redis.NewFailoverClient(c.options.Failover())
+	default:
+		options := c.options.Simple()
+		options.Network = c.network
+		c.c = redis.NewClient(options)
+	}
+	if err := c.c.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	if migrate {
+		return c.unregister(ctx)
+	}
 	return nil
 }
 
+// unregister removes the keys of this cacher from the hset_name hash left
+// by flush_mode=hset. The hash may be shared with cachers of other
+// prefixes, so only the fields starting with the prefix are deleted; Redis
+// drops the hash itself once its last field is gone.
+func (c *RedisCacher) unregister(ctx context.Context) error {
+	iter := c.c.HScan(ctx, c.hsetName, 0, escapePattern(c.prefix)+"*", scanCount).Iterator()
+	fields := make([]string, 0, delBatchSize)
+	for value := false; iter.Next(ctx); value = !value {
+		// HSCAN returns fields and values alternately.
+		if value {
+			continue
+		}
+		fields = append(fields, iter.Val())
+		if len(fields) == delBatchSize {
+			if err := c.c.HDel(ctx, c.hsetName, fields...).Err(); err != nil {
+				return err
+			}
+			fields = fields[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return c.c.HDel(ctx, c.hsetName, fields...).Err()
+}
+
 func (c *RedisCacher) Close() error {
 	if c.c == nil {
 		return nil
@@ -202,7 +450,25 @@ func (c *RedisCacher) Client() interface{} {
 	return c.c
 }
 
+// Options returns the options of the client of a single node or of a
+// Sentinel-managed master, or nil for a cluster, whose options are
+// returned by UniversalOptions.
 func (c *RedisCacher) Options() *redis.Options {
+	if client, ok := c.c.(*redis.Client); ok {
+		return client.Options()
+	}
+	return nil
+}
+
+// UniversalClient returns the client of the adapter, a *redis.Client,
+// *redis.ClusterClient or Sentinel-backed *redis.Client.
+func (c *RedisCacher) UniversalClient() redis.UniversalClient {
+	return c.c
+}
+
+// UniversalOptions returns the options of the client, whatever the
+// deployment.
+func (c *RedisCacher) UniversalOptions() *redis.UniversalOptions {
 	return c.options
 }
 
@@ -212,6 +478,9 @@ func (c *RedisCacher) Name() string {
 
 const cacheEngineRedis = `redis`
 
+// AsClient returns the client of a single node or of a Sentinel-managed
+// master. The client of a cluster is a *redis.ClusterClient; see
+// RedisCacher.UniversalClient.
 func AsClient(client interface{}) *redis.Client {
 	return client.(*redis.Client)
 }
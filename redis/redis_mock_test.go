@@ -2,12 +2,15 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/admpub/cache"
+	"github.com/admpub/cache/internal/tlsconfig/tlsconfigtest"
 )
 
 func TestCache(t *testing.T) {
@@ -57,3 +60,295 @@ func TestCache(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, true, exist)
 }
+
+func TestFlush(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	c := New().(*RedisCacher)
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addrs=` + s.Addr() + `,prefix=cache:`})
+	assert.NoError(t, err)
+	s.Set("unrelated", "value")
+
+	for _, cluster := range []bool{false, true} {
+		// The per-key pipeline used for clusters works on a single node too.
+		c.cluster = cluster
+		for i := 0; i < delBatchSize+10; i++ {
+			assert.NoError(t, c.Put(ctx, fmt.Sprintf("key%d", i), i, 0))
+		}
+		assert.NoError(t, c.Flush(ctx))
+		exist, err := c.IsExist(ctx, "key0")
+		assert.NoError(t, err)
+		assert.False(t, exist)
+		assert.True(t, s.Exists("unrelated"))
+		assert.False(t, s.Exists("Cache"))
+	}
+
+	// Flushing an empty registry is not an error.
+	assert.NoError(t, c.Flush(ctx))
+
+	c.occupyMode = true
+	assert.NoError(t, c.Flush(ctx))
+	assert.False(t, s.Exists("unrelated"))
+}
+
+func TestFlushScan(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Keys put in hset mode are left with a registry hash.
+	legacy := New()
+	err = legacy.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache[1]:`})
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Put(ctx, "old", "value", 0))
+	assert.True(t, s.Exists("Cache"))
+
+	c := New().(*RedisCacher)
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache[1]:,flush_mode=scan`})
+	assert.NoError(t, err)
+	assert.False(t, s.Exists("Cache"), "the legacy registry is removed")
+
+	for i := 0; i < delBatchSize+10; i++ {
+		assert.NoError(t, c.Put(ctx, fmt.Sprintf("key%d", i), i, 0))
+	}
+	assert.False(t, s.Exists("Cache"))
+	s.Set("cache1:unrelated", "value")
+	assert.NoError(t, c.Flush(ctx))
+	assert.Equal(t, []string{"cache1:unrelated"}, s.Keys())
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,flush_mode=scan`})
+	assert.Error(t, err, "scanning without a prefix would flush the database")
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,flush_mode=all`})
+	assert.Error(t, err)
+}
+
+func TestFlushScanSharedHash(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Cachers of two prefixes record their keys in the same hash.
+	for _, prefix := range []string{"app1:", "app2:"} {
+		legacy := New()
+		err = legacy.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=` + prefix})
+		assert.NoError(t, err)
+		assert.NoError(t, legacy.Put(ctx, "old", "value", 0))
+		legacy.Close()
+	}
+
+	c := New()
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=app1:,flush_mode=scan`})
+	assert.NoError(t, err)
+	defer c.Close()
+	fields, err := s.HKeys("Cache")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app2:old"}, fields, "the keys of other prefixes stay registered")
+
+	c2 := New()
+	err = c2.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=app2:,flush_mode=scan`})
+	assert.NoError(t, err)
+	defer c2.Close()
+	assert.False(t, s.Exists("Cache"), "the emptied registry is removed")
+}
+
+func TestParseConfig(t *testing.T) {
+	c := New().(*RedisCacher)
+	err := c.parseConfig(`addrs=10.0.0.1:26379|10.0.0.2:26379,master_name=mymaster,sentinel_password=secret,read_only=true`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:26379", "10.0.0.2:26379"}, c.options.Addrs)
+	assert.Equal(t, "mymaster", c.options.MasterName)
+	assert.Equal(t, "secret", c.options.SentinelPassword)
+	assert.True(t, c.options.ReadOnly)
+	assert.False(t, c.cluster)
+
+	err = c.parseConfig(`addrs=10.0.0.1:6379|10.0.0.2:6379,route_by_latency=true`)
+	assert.NoError(t, err)
+	assert.True(t, c.cluster)
+	assert.True(t, c.options.RouteByLatency)
+
+	err = c.parseConfig(`addr=10.0.0.1:6379,cluster=true`)
+	assert.NoError(t, err)
+	assert.True(t, c.cluster)
+
+	err = c.parseConfig(`network=unix,addr=/tmp/redis.sock`)
+	assert.NoError(t, err)
+	assert.False(t, c.cluster)
+	assert.Equal(t, "unix", c.network)
+
+	err = c.parseConfig(`addr=10.0.0.1:6379,dial_timeout=2.5,read_timeout=3,write_timeout=4,max_retries=5,min_idle_conns=6`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, c.options.DialTimeout)
+	assert.Equal(t, 3*time.Second, c.options.ReadTimeout)
+	assert.Equal(t, 4*time.Second, c.options.WriteTimeout)
+	assert.Equal(t, 5, c.options.MaxRetries)
+	assert.Equal(t, 6, c.options.MinIdleConns)
+	assert.Nil(t, c.options.TLSConfig)
+
+	err = c.parseConfig(`addr=10.0.0.1:6379,max_retries=0`)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c.options.MaxRetries, "go-redis retries 3 times by default")
+	err = c.parseConfig(`addr=10.0.0.1:6379,max_retries=-1`)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, c.options.MaxRetries)
+
+	assert.Error(t, c.parseConfig(`addr=10.0.0.1:6379,tls_ca_file=/nonexistent/ca.pem`))
+	assert.Error(t, c.parseConfig(`addr=10.0.0.1:26379,master_name=mymaster,cluster=true`))
+	assert.Error(t, c.parseConfig(`unknown=1`))
+	assert.EqualError(t, c.parseConfig(`addr=10.0.0.1:6379,addrs=10.0.0.2:6379|10.0.0.3:6379`),
+		"cache/redis: addr and addrs are mutually exclusive")
+}
+
+func TestClient(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	c := New().(*RedisCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,db=1`}))
+	defer c.Close()
+
+	assert.Equal(t, s.Addr(), AsClient(c.Client()).Options().Addr)
+	assert.Equal(t, 1, c.Options().DB)
+	assert.Equal(t, []string{s.Addr()}, c.UniversalOptions().Addrs)
+	assert.Same(t, AsClient(c.Client()), c.UniversalClient())
+	assert.Nil(t, New().(*RedisCacher).Options(), "no client is started yet")
+}
+
+func TestAuthAndTLS(t *testing.T) {
+	files, serverConfig := tlsconfigtest.WriteFiles(t)
+	s, err := miniredis.RunTLS(serverConfig)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	s.RequireUserAuth("app", "secret")
+	ctx := context.Background()
+
+	config := `addr=` + s.Addr() + `,username=app,password=secret,dial_timeout=2,tls_ca_file=` + files.CAFile +
+		`,tls_cert_file=` + files.CertFile + `,tls_key_file=` + files.KeyFile
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: config}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,username=app,password=wrong,tls_ca_file=` + files.CAFile +
+		`,tls_cert_file=` + files.CertFile + `,tls_key_file=` + files.KeyFile})
+	assert.Error(t, err)
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,username=app,password=secret,tls_ca_file=` + files.CAFile})
+	assert.Error(t, err, "the server requires a client certificate")
+}
+
+func TestCounter(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:`}))
+	assert.NoError(t, c.Put(ctx, "counter", int64(1), 3600))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, int64(2), c.Int64(ctx, "counter"))
+	assert.Equal(t, time.Hour, s.TTL("cache:counter"), "the TTL is kept")
+
+	// A missing counter is not created.
+	assert.EqualError(t, c.Incr(ctx, "missing"), "key 'missing' not exist")
+	assert.EqualError(t, c.Decr(ctx, "missing"), "key 'missing' not exist")
+	assert.False(t, s.Exists("cache:missing"))
+
+	assert.NoError(t, c.Put(ctx, "text", "value", 0))
+	assert.Error(t, c.Incr(ctx, "text"))
+
+	// The script is loaded again once the server has forgotten it.
+	assert.NoError(t, AsClient(c.Client()).ScriptFlush(ctx).Err())
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.Equal(t, int64(3), c.Int64(ctx, "counter"))
+
+	// Connection errors are reported rather than taken for missing keys.
+	s.Close()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, err = c.IsExist(ctx, "counter")
+	assert.Error(t, err)
+	assert.Error(t, c.Incr(ctx, "counter"))
+}
+
+type profile struct {
+	Name    string            `cache:"name"`
+	Visits  int64             `cache:"visits"`
+	Labels  map[string]string `cache:"labels"`
+	Comment string            `cache:"-"`
+}
+
+func TestFields(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:`}))
+	fc := cache.Fields(c)
+	assert.Same(t, c, fc)
+
+	p := &profile{Name: "A", Visits: 1, Labels: map[string]string{"k": "v"}, Comment: "c"}
+	assert.NoError(t, fc.PutFields(ctx, "profile", p, 3600))
+	assert.Equal(t, "1", s.HGet("cache:profile", "visits"))
+	assert.Equal(t, `{"k":"v"}`, s.HGet("cache:profile", "labels"))
+	assert.True(t, s.Exists("Cache"), "the key is registered for Flush")
+
+	recv := &profile{}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv))
+	assert.Equal(t, &profile{Name: "A", Visits: 1, Labels: map[string]string{"k": "v"}}, recv)
+
+	assert.NoError(t, fc.UpdateField(ctx, "profile", "name", "B"))
+	visits, err := fc.IncrField(ctx, "profile", "visits", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), visits)
+	assert.Equal(t, time.Hour, s.TTL("cache:profile"), "the TTL is kept")
+
+	recv = &profile{}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv, "name", "visits"))
+	assert.Equal(t, &profile{Name: "B", Visits: 3}, recv)
+
+	assert.NoError(t, fc.UpdateField(ctx, "profile", "labels", nil))
+	recv = &profile{Labels: map[string]string{"old": "value"}}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv, "labels"))
+	assert.Nil(t, recv.Labels)
+
+	assert.Equal(t, cache.ErrNotFound, fc.GetFields(ctx, "missing", recv))
+	assert.Equal(t, cache.ErrNotFound, fc.GetFields(ctx, "profile", recv, "unknown"))
+	assert.Equal(t, cache.ErrNotFound, fc.UpdateField(ctx, "missing", "name", "C"))
+	_, err = fc.IncrField(ctx, "missing", "visits", 1)
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.False(t, s.Exists("cache:missing"))
+	_, err = fc.IncrField(ctx, "profile", "name", 1)
+	assert.Error(t, err)
+
+	// PutFields replaces the hash.
+	assert.NoError(t, fc.PutFields(ctx, "profile", &profile{Name: "D"}, 0))
+	assert.Equal(t, time.Duration(0), s.TTL("cache:profile"))
+	assert.Equal(t, "0", s.HGet("cache:profile", "visits"))
+
+	assert.NoError(t, c.Flush(ctx))
+	assert.False(t, s.Exists("cache:profile"))
+}
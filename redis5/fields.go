@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/redis.v5"
+
+	"github.com/admpub/cache"
+)
+
+var _ cache.FieldsCache = (*RedisCacher)(nil)
+
+// fieldScript sets (ARGV[1] = set) or increments (ARGV[1] = incr) the field
+// ARGV[2] of the hash KEYS[1] by ARGV[3] and returns nil if the hash does
+// not exist, so that an expired value is not recreated without its TTL.
+var fieldScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+if ARGV[1] == 'incr' then
+	return redis.call('HINCRBY', KEYS[1], ARGV[2], ARGV[3])
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// PutFields puts the fields of the struct val into a hash with key and
+// expire time, replacing the fields stored before.
+// If expired is 0, it lives forever.
+func (c *RedisCacher) PutFields(ctx context.Context, key string, val interface{}, expire int64) error {
+	fields, err := cache.EncodeFields(c.codec, val)
+	if err != nil {
+		return err
+	}
+	key = c.prefix + key
+	_, err = c.c.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.Del(key)
+		pipe.HMSet(key, fields)
+		if expire > 0 {
+			pipe.Expire(key, time.Duration(expire)*time.Second)
+		}
+		return nil
+	})
+	if err != nil || !c.registry() {
+		return err
+	}
+	return c.c.HSet(c.hsetName, key, "0").Err()
+}
+
+// GetFields decodes the named fields of the hash by given key, or all of
+// them if none is named, into the struct pointed to by val.
+func (c *RedisCacher) GetFields(ctx context.Context, key string, val interface{}, fields ...string) error {
+	var values map[string]string
+	if len(fields) == 0 {
+		var err error
+		if values, err = c.c.HGetAll(c.prefix + key).Result(); err != nil {
+			return err
+		}
+	} else {
+		list, err := c.c.HMGet(c.prefix+key, fields...).Result()
+		if err != nil {
+			return err
+		}
+		values = make(map[string]string, len(fields))
+		for i, v := range list {
+			if s, ok := v.(string); ok {
+				values[fields[i]] = s
+			}
+		}
+	}
+	if len(values) == 0 {
+		return cache.ErrNotFound
+	}
+	return cache.DecodeFields(c.codec, values, val)
+}
+
+// UpdateField sets a field of the hash by given key, keeping its expiration.
+func (c *RedisCacher) UpdateField(ctx context.Context, key string, field string, val interface{}) error {
+	value, err := cache.EncodeField(c.codec, val)
+	if err != nil {
+		return err
+	}
+	err = fieldScript.Run(c.c, []string{c.prefix + key}, "set", field, value).Err()
+	if err == redis.Nil {
+		return cache.ErrNotFound
+	}
+	return err
+}
+
+// IncrField adds n to an integer field of the hash by given key and returns
+// the result.
+func (c *RedisCacher) IncrField(ctx context.Context, key string, field string, n int64) (int64, error) {
+	r, err := fieldScript.Run(c.c, []string{c.prefix + key}, "incr", field, n).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, cache.ErrNotFound
+		}
+		return 0, err
+	}
+	i, _ := r.(int64)
+	return i, nil
+}
@@ -16,7 +16,10 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -25,6 +28,7 @@ import (
 
 	"github.com/admpub/cache"
 	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/internal/tlsconfig"
 	"github.com/admpub/ini"
 )
 
@@ -36,9 +40,24 @@ type RedisCacher struct {
 	options    *redis.Options
 	prefix     string
 	hsetName   string
+	flushMode  string
 	occupyMode bool
 }
 
+// Flush modes, selecting how Flush finds the keys of the cache when the
+// database is shared (OccupyMode is false).
+const (
+	// FlushModeHSet records every key in the hset_name hash.
+	FlushModeHSet = "hset"
+	// FlushModeScan finds the keys by scanning for the prefix.
+	FlushModeScan = "scan"
+)
+
+// registry reports whether keys are recorded in the hset_name hash.
+func (c *RedisCacher) registry() bool {
+	return !c.occupyMode && c.flushMode != FlushModeScan
+}
+
 func (c *RedisCacher) SetCodec(codec encoding.Codec) {
 	c.codec = codec
 }
@@ -58,7 +77,7 @@ func (c *RedisCacher) Put(ctx context.Context, key string, val interface{}, expi
 	if err := c.c.Set(key, com.Bytes2str(value), time.Duration(expire)*time.Second).Err(); err != nil {
 		return err
 	}
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HSet(c.hsetName, key, "0").Err()
@@ -87,7 +106,7 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 		return err
 	}
 
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HDel(c.hsetName, key).Err()
@@ -95,34 +114,42 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *RedisCacher) Incr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("key '%s' not exist", key)
-	}
-	return c.c.Incr(c.prefix + key).Err()
+	return c.incrBy(ctx, key, 1)
 }
 
 // Decr decreases cached int-type value by given key as a counter.
 func (c *RedisCacher) Decr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
+	return c.incrBy(ctx, key, -1)
+}
+
+// counterScript adds ARGV[1] to the integer stored at KEYS[1] and returns
+// nil if the key does not exist, so that a counter which expired is not
+// recreated without its TTL. INCRBY itself keeps the TTL.
+var counterScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`)
+
+// incrBy atomically adds n to the counter stored under key.
+func (c *RedisCacher) incrBy(ctx context.Context, key string, n int64) error {
+	err := counterScript.Run(c.c, []string{c.prefix + key}, n).Err()
+	if err == redis.Nil {
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	return c.c.Decr(c.prefix + key).Err()
+	return err
 }
 
 // IsExist returns true if cached value exists.
 func (c *RedisCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	if c.c.Exists(c.prefix + key).Val() {
-		return true, nil
+	exist, err := c.c.Exists(c.prefix + key).Result()
+	if err != nil || exist {
+		return exist, err
 	}
 
-	if !c.occupyMode {
-		c.c.HDel(c.hsetName, c.prefix+key)
+	if c.registry() {
+		return false, c.c.HDel(c.hsetName, c.prefix+key).Err()
 	}
 	return false, nil
 }
@@ -132,24 +159,118 @@ func (c *RedisCacher) Flush(ctx context.Context) error {
 	if c.occupyMode {
 		return c.c.FlushDb().Err()
 	}
+	if c.flushMode == FlushModeScan {
+		return c.flushPrefix()
+	}
 
 	keys, err := c.c.HKeys(c.hsetName).Result()
 	if err != nil {
 		return err
 	}
-	if err = c.c.Del(keys...).Err(); err != nil {
+	if err = c.unlink(keys); err != nil {
 		return err
 	}
 	return c.c.Del(c.hsetName).Err()
 }
 
+const (
+	// scanCount is the COUNT hint of the SCAN calls of Flush.
+	scanCount = 1000
+	// delBatchSize bounds the number of keys deleted per round trip.
+	delBatchSize = 500
+)
+
+// flushPrefix deletes the keys starting with the prefix.
+func (c *RedisCacher) flushPrefix() error {
+	iter := c.c.Scan(0, escapePattern(c.prefix)+"*", scanCount).Iterator()
+	keys := make([]string, 0, delBatchSize)
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+		if len(keys) == delBatchSize {
+			if err := c.unlink(keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return c.unlink(keys)
+}
+
+// unlink deletes keys in batches, reclaiming their memory in the background.
+func (c *RedisCacher) unlink(keys []string) error {
+	for len(keys) > 0 {
+		n := delBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := c.c.Unlink(keys[:n]...).Err(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// escapePattern escapes the glob characters of a SCAN MATCH pattern.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // StartAndGC starts GC routine based on config string settings.
 // AdapterConfig: network=tcp,addr=:6379,password=123456,db=0,pool_size=100,idle_timeout=180,hset_name=Cache,prefix=cache:
+//
+// username selects an ACL user. Timeouts are in seconds: dial_timeout,
+// read_timeout and write_timeout. redis.v5 keeps no idle connections and
+// ignores min_idle_conns. tls=true encrypts connections, which tls_ca_file,
+// tls_cert_file, tls_key_file, tls_server_name and tls_insecure_skip_verify
+// configure.
+//
+// max_retries is the number of retries of a failed command: 0 keeps the
+// default of the client library and -1 disables retries.
+//
+// flush_mode=scan stops recording keys in the hset_name hash, which grows
+// with every key put, and makes Flush scan for the keys starting with the
+// prefix instead; the prefix is then required. The keys of the prefix that
+// the default flush_mode=hset recorded in the hash are removed on start.
 func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
 	c.hsetName = "Cache"
+	c.flushMode = FlushModeHSet
 	c.occupyMode = opts.OccupyMode
 
-	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
+	if err := c.parseConfig(opts.AdapterConfig); err != nil {
+		return err
+	}
+
+	migrate := c.flushMode == FlushModeScan && !c.occupyMode
+	if migrate && len(c.prefix) == 0 {
+		return fmt.Errorf("cache/redis: flush_mode=scan requires a prefix")
+	}
+
+	c.c = redis.NewClient(c.options)
+	if err := c.c.Ping().Err(); err != nil {
+		return err
+	}
+
+	if migrate {
+		return c.unregister()
+	}
+	return nil
+}
+
+// parseConfig reads the AdapterConfig settings into c.
+func (c *RedisCacher) parseConfig(config string) error {
+	cfg, err := ini.Load([]byte(strings.Replace(config, ",", "\n", -1)))
 	if err != nil {
 		return err
 	}
@@ -157,37 +278,163 @@ func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error
 	c.options = &redis.Options{
 		Network: "tcp",
 	}
+	var username string
+	var tlsOptions tlsconfig.Options
 	for k, v := range cfg.Section("").KeysHash() {
 		switch k {
 		case "network":
 			c.options.Network = v
 		case "addr":
 			c.options.Addr = v
+		case "username":
+			username = v
 		case "password":
 			c.options.Password = v
 		case "db":
 			c.options.DB = com.Int(v)
 		case "pool_size":
 			c.options.PoolSize = com.Int(v)
+		case "min_idle_conns":
+		case "max_retries":
+			// redis.v5 does not retry by default.
+			if c.options.MaxRetries = com.Int(v); c.options.MaxRetries < 0 {
+				c.options.MaxRetries = 0
+			}
 		case "idle_timeout":
 			c.options.IdleTimeout, err = time.ParseDuration(v + "s")
 			if err != nil {
 				return fmt.Errorf("error parsing idle timeout: %v", err)
 			}
+		case "dial_timeout":
+			c.options.DialTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing dial timeout: %v", err)
+			}
+		case "read_timeout":
+			c.options.ReadTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing read timeout: %v", err)
+			}
+		case "write_timeout":
+			c.options.WriteTimeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing write timeout: %v", err)
+			}
 		case "hset_name":
 			c.hsetName = v
+		case "flush_mode":
+			if v != FlushModeHSet && v != FlushModeScan {
+				return fmt.Errorf("cache/redis: invalid flush_mode '%s'", v)
+			}
+			c.flushMode = v
 		case "prefix":
 			c.prefix = v
 		default:
-			return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			if !tlsOptions.Set(k, v) {
+				return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			}
 		}
 	}
+	if c.options.TLSConfig, err = tlsOptions.Config(); err != nil {
+		return fmt.Errorf("cache/redis: %v", err)
+	}
+	if c.options.TLSConfig != nil || len(username) > 0 {
+		c.options.Dialer = dialer(c.options, username)
+		if len(username) > 0 {
+			// Authenticated by the dialer.
+			c.options.Password = ""
+		}
+	}
+	return nil
+}
 
-	c.c = redis.NewClient(c.options)
-	if err = c.c.Ping().Err(); err != nil {
+// unregister removes the keys of this cacher from the hset_name hash left
+// by flush_mode=hset. The hash may be shared with cachers of other
+// prefixes, so only the fields starting with the prefix are deleted; Redis
+// drops the hash itself once its last field is gone.
+func (c *RedisCacher) unregister() error {
+	iter := c.c.HScan(c.hsetName, 0, escapePattern(c.prefix)+"*", scanCount).Iterator()
+	fields := make([]string, 0, delBatchSize)
+	for value := false; iter.Next(); value = !value {
+		// HSCAN returns fields and values alternately.
+		if value {
+			continue
+		}
+		fields = append(fields, iter.Val())
+		if len(fields) == delBatchSize {
+			if err := c.c.HDel(c.hsetName, fields...).Err(); err != nil {
+				return err
+			}
+			fields = fields[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
 		return err
 	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return c.c.HDel(c.hsetName, fields...).Err()
+}
 
+// dialer returns a Dialer for opt that verifies the server name of TLS
+// connections against the host of the address, like the newer clients do,
+// and sends the two-argument AUTH of Redis 6 ACLs, which redis.v5 lacks,
+// when username is set.
+func dialer(opt *redis.Options, username string) func() (net.Conn, error) {
+	password := opt.Password
+	config := opt.TLSConfig
+	if config != nil && len(config.ServerName) == 0 && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(opt.Addr)
+	}
+	return func() (net.Conn, error) {
+		conn, err := net.DialTimeout(opt.Network, opt.Addr, opt.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			tc := tls.Client(conn, config)
+			if err = tc.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tc
+		}
+		if len(username) > 0 {
+			if err = auth(conn, opt.DialTimeout, username, password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// auth sends AUTH username password on conn and reads the reply.
+func auth(conn net.Conn, timeout time.Duration, username string, password string) error {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	cmd := fmt.Sprintf("*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(username), username, len(password), password)
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+	// The reply is read byte by byte so that nothing past it is consumed
+	// before the connection is handed to the client.
+	var reply []byte
+	b := make([]byte, 1)
+	for len(reply) == 0 || reply[len(reply)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		reply = append(reply, b[0])
+	}
+	line := strings.TrimRight(string(reply), "\r\n")
+	if line != "+OK" {
+		return errors.New(strings.TrimPrefix(line, "-"))
+	}
 	return nil
 }
 
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/redis/rueidis"
+
+	"github.com/admpub/cache"
+)
+
+var _ cache.FieldsCache = (*RedisCacher)(nil)
+
+// fieldScript sets (ARGV[1] = set) or increments (ARGV[1] = incr) the field
+// ARGV[2] of the hash KEYS[1] by ARGV[3] and returns nil if the hash does
+// not exist, so that an expired value is not recreated without its TTL.
+var fieldScript = rueidis.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+if ARGV[1] == 'incr' then
+	return redis.call('HINCRBY', KEYS[1], ARGV[2], ARGV[3])
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
+// PutFields puts the fields of the struct val into a hash with key and
+// expire time, replacing the fields stored before.
+// If expired is 0, it lives forever.
+func (c *RedisCacher) PutFields(ctx context.Context, key string, val interface{}, expire int64) error {
+	fields, err := cache.EncodeFields(c.codec, val)
+	if err != nil {
+		return err
+	}
+	key = c.prefix + key
+	hset := c.client.B().Hset().Key(key).FieldValue()
+	for k, v := range fields {
+		hset = hset.FieldValue(k, v)
+	}
+	cmds := rueidis.Commands{
+		c.client.B().Multi().Build(),
+		c.client.B().Del().Key(key).Build(),
+		hset.Build(),
+	}
+	if expire > 0 {
+		cmds = append(cmds, c.client.B().Expire().Key(key).Seconds(expire).Build())
+	}
+	cmds = append(cmds, c.client.B().Exec().Build())
+	for _, resp := range c.client.DoMulti(ctx, cmds...) {
+		if err = resp.Error(); err != nil {
+			return err
+		}
+	}
+	if !c.registry() {
+		return nil
+	}
+	return c.c.HSet(ctx, c.hsetName, key, "0").Err()
+}
+
+// GetFields decodes the named fields of the hash by given key, or all of
+// them if none is named, into the struct pointed to by val. The hash is
+// read through the client-side cache when client_cache_ttl is set.
+func (c *RedisCacher) GetFields(ctx context.Context, key string, val interface{}, fields ...string) error {
+	var values map[string]string
+	if len(fields) == 0 {
+		cmd := c.client.B().Hgetall().Key(c.prefix + key).Cache()
+		var err error
+		if values, err = c.doCache(ctx, cmd).AsStrMap(); err != nil {
+			return err
+		}
+	} else {
+		cmd := c.client.B().Hmget().Key(c.prefix + key).Field(fields...).Cache()
+		list, err := c.doCache(ctx, cmd).ToArray()
+		if err != nil {
+			return err
+		}
+		values = make(map[string]string, len(fields))
+		for i, v := range list {
+			if s, err := v.ToString(); err == nil {
+				values[fields[i]] = s
+			} else if !rueidis.IsRedisNil(err) {
+				return err
+			}
+		}
+	}
+	if len(values) == 0 {
+		return cache.ErrNotFound
+	}
+	return cache.DecodeFields(c.codec, values, val)
+}
+
+// UpdateField sets a field of the hash by given key, keeping its expiration.
+func (c *RedisCacher) UpdateField(ctx context.Context, key string, field string, val interface{}) error {
+	value, err := cache.EncodeField(c.codec, val)
+	if err != nil {
+		return err
+	}
+	err = fieldScript.Exec(ctx, c.client, []string{c.prefix + key}, []string{"set", field, value}).Error()
+	if rueidis.IsRedisNil(err) {
+		return cache.ErrNotFound
+	}
+	return err
+}
+
+// IncrField adds n to an integer field of the hash by given key and returns
+// the result.
+func (c *RedisCacher) IncrField(ctx context.Context, key string, field string, n int64) (int64, error) {
+	i, err := fieldScript.Exec(ctx, c.client, []string{c.prefix + key}, []string{"incr", field, strconv.FormatInt(n, 10)}).AsInt64()
+	if rueidis.IsRedisNil(err) {
+		return 0, cache.ErrNotFound
+	}
+	return i, err
+}
@@ -17,11 +17,14 @@ package cache
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/admpub/cache"
 	"github.com/admpub/cache/encoding"
+	"github.com/admpub/cache/internal/tlsconfig"
 	"github.com/admpub/ini"
 	"github.com/redis/rueidis"
 	"github.com/redis/rueidis/rueidiscompat"
@@ -37,7 +40,56 @@ type RedisCacher struct {
 	options    *rueidis.ClientOption
 	prefix     string
 	hsetName   string
+	flushMode  string
 	occupyMode bool
+	cacheTTL   time.Duration // client-side cache TTL, 0 if reads bypass the cache
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+// ClientCacheStats counts the reads served by the client-side cache.
+type ClientCacheStats struct {
+	Hits   uint64 // reads answered from local memory
+	Misses uint64 // reads sent to the server
+}
+
+// ClientCacheStats returns the client-side cache counters, which stay zero
+// unless client_cache_ttl is set.
+func (c *RedisCacher) ClientCacheStats() ClientCacheStats {
+	return ClientCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// count records whether resp came from the client-side cache.
+func (c *RedisCacher) count(resp rueidis.RedisResult) {
+	if resp.IsCacheHit() {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// doCache runs cmd through the client-side cache when it is enabled.
+func (c *RedisCacher) doCache(ctx context.Context, cmd rueidis.Cacheable) rueidis.RedisResult {
+	if c.cacheTTL <= 0 {
+		return c.client.Do(ctx, rueidis.Completed(cmd))
+	}
+	resp := c.client.DoCache(ctx, cmd, c.cacheTTL)
+	c.count(resp)
+	return resp
+}
+
+// Flush modes, selecting how Flush finds the keys of the cache when the
+// database is shared (OccupyMode is false).
+const (
+	// FlushModeHSet records every key in the hset_name hash.
+	FlushModeHSet = "hset"
+	// FlushModeScan finds the keys by scanning for the prefix.
+	FlushModeScan = "scan"
+)
+
+// registry reports whether keys are recorded in the hset_name hash.
+func (c *RedisCacher) registry() bool {
+	return !c.occupyMode && c.flushMode != FlushModeScan
 }
 
 func (c *RedisCacher) SetCodec(codec encoding.Codec) {
@@ -59,7 +111,7 @@ func (c *RedisCacher) Put(ctx context.Context, key string, val interface{}, expi
 	if err := c.c.Set(ctx, key, com.Bytes2str(value), time.Duration(expire)*time.Second).Err(); err != nil {
 		return err
 	}
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HSet(ctx, c.hsetName, key, "0").Err()
@@ -67,7 +119,7 @@ func (c *RedisCacher) Put(ctx context.Context, key string, val interface{}, expi
 
 // Get gets cached value by given key.
 func (c *RedisCacher) Get(ctx context.Context, key string, value interface{}) error {
-	val, err := c.c.Get(ctx, c.prefix+key).Bytes()
+	val, err := c.doCache(ctx, c.client.B().Get().Key(c.prefix+key).Cache()).AsBytes()
 	if err != nil {
 		if rueidis.IsRedisNil(err) {
 			return cache.ErrNotFound
@@ -81,6 +133,51 @@ func (c *RedisCacher) Get(ctx context.Context, key string, value interface{}) er
 	return c.codec.Unmarshal(val, value)
 }
 
+// GetMulti gets the cached values of several keys in one round trip.
+// values maps each key to the pointer its value is decoded into; the keys
+// which are not found are removed from values.
+func (c *RedisCacher) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	var resps []rueidis.RedisResult
+	if c.cacheTTL <= 0 {
+		cmds := make(rueidis.Commands, len(keys))
+		for i, key := range keys {
+			cmds[i] = c.client.B().Get().Key(c.prefix + key).Build()
+		}
+		resps = c.client.DoMulti(ctx, cmds...)
+	} else {
+		cmds := make([]rueidis.CacheableTTL, len(keys))
+		for i, key := range keys {
+			cmds[i] = rueidis.CT(c.client.B().Get().Key(c.prefix+key).Cache(), c.cacheTTL)
+		}
+		resps = c.client.DoMultiCache(ctx, cmds...)
+		for _, resp := range resps {
+			c.count(resp)
+		}
+	}
+	for i, resp := range resps {
+		val, err := resp.AsBytes()
+		if err != nil {
+			if !rueidis.IsRedisNil(err) {
+				return err
+			}
+			delete(values, keys[i])
+			continue
+		}
+		if len(val) == 0 {
+			delete(values, keys[i])
+			continue
+		}
+		if err = c.codec.Unmarshal(val, values[keys[i]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Delete deletes cached value by given key.
 func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 	key = c.prefix + key
@@ -88,7 +185,7 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 		return err
 	}
 
-	if c.occupyMode {
+	if !c.registry() {
 		return nil
 	}
 	return c.c.HDel(ctx, c.hsetName, key).Err()
@@ -96,34 +193,55 @@ func (c *RedisCacher) Delete(ctx context.Context, key string) error {
 
 // Incr increases cached int-type value by given key as a counter.
 func (c *RedisCacher) Incr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("key '%s' not exist", key)
-	}
-	return c.c.Incr(ctx, c.prefix+key).Err()
+	return c.incrBy(ctx, key, 1)
 }
 
 // Decr decreases cached int-type value by given key as a counter.
 func (c *RedisCacher) Decr(ctx context.Context, key string) error {
-	if exist, err := c.IsExist(ctx, key); !exist {
-		if err != nil {
-			return err
-		}
+	return c.incrBy(ctx, key, -1)
+}
+
+// counterScript adds ARGV[1] to the integer stored at KEYS[1] and returns
+// nil if the key does not exist, so that a counter which expired is not
+// recreated without its TTL. INCRBY itself keeps the TTL.
+var counterScript = rueidis.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`)
+
+// incrBy atomically adds n to the counter stored under key.
+func (c *RedisCacher) incrBy(ctx context.Context, key string, n int64) error {
+	err := counterScript.Exec(ctx, c.client, []string{c.prefix + key}, []string{strconv.FormatInt(n, 10)}).Error()
+	if rueidis.IsRedisNil(err) {
 		return fmt.Errorf("key '%s' not exist", key)
 	}
-	return c.c.Decr(ctx, c.prefix+key).Err()
+	return err
 }
 
 // IsExist returns true if cached value exists.
 func (c *RedisCacher) IsExist(ctx context.Context, key string) (bool, error) {
-	if c.c.Exists(ctx, c.prefix+key).Val() > 0 {
-		return true, nil
+	var n int64
+	var err error
+	if c.cacheTTL > 0 {
+		// EXISTS cannot be cached, TYPE can and replies none for a
+		// missing key.
+		resp := c.client.DoCache(ctx, c.client.B().Type().Key(c.prefix+key).Cache(), c.cacheTTL)
+		c.count(resp)
+		var typ string
+		if typ, err = resp.ToString(); typ != "none" && err == nil {
+			n = 1
+		}
+	} else {
+		n, err = c.c.Exists(ctx, c.prefix+key).Result()
+	}
+	if err != nil || n > 0 {
+		return n > 0, err
 	}
 
-	if !c.occupyMode {
-		c.c.HDel(ctx, c.hsetName, c.prefix+key)
+	if c.registry() {
+		return false, c.c.HDel(ctx, c.hsetName, c.prefix+key).Err()
 	}
 	return false, nil
 }
@@ -133,24 +251,171 @@ func (c *RedisCacher) Flush(ctx context.Context) error {
 	if c.occupyMode {
 		return c.c.FlushDB(ctx).Err()
 	}
+	if c.flushMode == FlushModeScan {
+		return c.flushPrefix(ctx)
+	}
 
 	keys, err := c.c.HKeys(ctx, c.hsetName).Result()
 	if err != nil {
 		return err
 	}
-	if err = c.c.Del(ctx, keys...).Err(); err != nil {
+	if err = c.unlink(ctx, keys); err != nil {
 		return err
 	}
 	return c.c.Del(ctx, c.hsetName).Err()
 }
 
+const (
+	// scanCount is the COUNT hint of the SCAN calls of Flush.
+	scanCount = 1000
+	// delBatchSize bounds the number of keys deleted per round trip.
+	delBatchSize = 500
+)
+
+// flushPrefix deletes the keys starting with the prefix, scanning every
+// node of a cluster.
+func (c *RedisCacher) flushPrefix(ctx context.Context) error {
+	pattern := escapePattern(c.prefix) + "*"
+	for _, node := range c.client.Nodes() {
+		var cursor uint64
+		for {
+			entry, err := node.Do(ctx, node.B().Scan().Cursor(cursor).Match(pattern).Count(scanCount).Build()).AsScanEntry()
+			if err != nil {
+				return err
+			}
+			if err = c.unlink(ctx, entry.Elements); err != nil {
+				return err
+			}
+			if cursor = entry.Cursor; cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// unlink deletes keys in batches, reclaiming their memory in the
+// background. Keys of a cluster may live in different hash slots, so they
+// are deleted one by one, each command being routed to the owning node.
+func (c *RedisCacher) unlink(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := delBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		if c.client.Mode() != rueidis.ClientModeCluster {
+			if err := c.client.Do(ctx, c.client.B().Unlink().Key(batch...).Build()).Error(); err != nil {
+				return err
+			}
+			continue
+		}
+		cmds := make(rueidis.Commands, len(batch))
+		for i, key := range batch {
+			cmds[i] = c.client.B().Unlink().Key(key).Build()
+		}
+		for _, resp := range c.client.DoMulti(ctx, cmds...) {
+			if err := resp.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// escapePattern escapes the glob characters of a SCAN MATCH pattern.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// retryPolicy returns the retry settings allowing maxRetries retries of a
+// command, with the exponential backoff of rueidis capped at one second.
+// Zero keeps the default policy of rueidis and a negative value disables
+// retries.
+func retryPolicy(maxRetries int) (bool, rueidis.RetryDelayFn) {
+	switch {
+	case maxRetries < 0:
+		return true, nil
+	case maxRetries == 0:
+		return false, nil
+	}
+	return false, func(attempts int, _ rueidis.Completed, _ error) time.Duration {
+		if attempts >= maxRetries {
+			return -1
+		}
+		return min(time.Second, time.Millisecond<<attempts)
+	}
+}
+
 // StartAndGC starts GC routine based on config string settings.
 // AdapterConfig: network=tcp,addr=:6379,password=123456,db=0,pool_size=100,idle_timeout=180,hset_name=Cache,prefix=cache:
+//
+// username selects an ACL user. Timeouts are in seconds: dial_timeout, and
+// read_timeout and write_timeout, which rueidis merges into one connection
+// timeout. min_idle_conns bounds the idle connections closed after
+// idle_timeout. tls=true encrypts connections, which tls_ca_file,
+// tls_cert_file, tls_key_file, tls_server_name and tls_insecure_skip_verify
+// configure.
+//
+// max_retries is the number of retries of a failed command: 0 keeps the
+// default of the client library and -1 disables retries.
+// rueidis only retries read-only commands.
+//
+// client_cache_ttl (seconds) makes Get, GetMulti and IsExist read through
+// the server-assisted client-side cache of rueidis, keeping the replies in
+// local memory for at most that long or until the server invalidates them;
+// client_cache_max_memory bounds the cache of each connection in bytes
+// (128 MiB by default). Servers without RESP3 disable the cache. See
+// ClientCacheStats for its hit rate.
+//
+// flush_mode=scan stops recording keys in the hset_name hash, which grows
+// with every key put, and makes Flush scan for the keys starting with the
+// prefix instead; the prefix is then required. The keys of the prefix that
+// the default flush_mode=hset recorded in the hash are removed on start.
 func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error {
 	c.hsetName = "Cache"
+	c.flushMode = FlushModeHSet
 	c.occupyMode = opts.OccupyMode
 
-	cfg, err := ini.Load([]byte(strings.Replace(opts.AdapterConfig, ",", "\n", -1)))
+	if err := c.parseConfig(opts.AdapterConfig); err != nil {
+		return err
+	}
+
+	migrate := c.flushMode == FlushModeScan && !c.occupyMode
+	if migrate && len(c.prefix) == 0 {
+		return fmt.Errorf("cache/redis: flush_mode=scan requires a prefix")
+	}
+
+	var err error
+	c.client, err = rueidis.NewClient(*c.options)
+	if err != nil {
+		if strings.Contains(err.Error(), `not supporting RESP3`) {
+			c.options.DisableCache = true
+			c.client, err = rueidis.NewClient(*c.options)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.c = rueidiscompat.NewAdapter(c.client)
+	if migrate {
+		return c.unregister(ctx)
+	}
+	return nil
+}
+
+// parseConfig reads the AdapterConfig settings into c.
+func (c *RedisCacher) parseConfig(config string) error {
+	cfg, err := ini.Load([]byte(strings.Replace(config, ",", "\n", -1)))
 	if err != nil {
 		return err
 	}
@@ -158,6 +423,8 @@ func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error
 	c.options = &rueidis.ClientOption{
 		InitAddress: []string{},
 	}
+	c.cacheTTL = 0
+	var tlsOptions tlsconfig.Options
 	for k, v := range cfg.Section("").KeysHash() {
 		switch k {
 		case "network":
@@ -171,32 +438,84 @@ func (c *RedisCacher) StartAndGC(ctx context.Context, opts cache.Options) error
 			c.options.SelectDB = com.Int(v)
 		case "pool_size":
 			c.options.BlockingPoolSize = com.Int(v)
+		case "min_idle_conns":
+			c.options.BlockingPoolMinSize = com.Int(v)
+		case "max_retries":
+			c.options.DisableRetry, c.options.RetryDelay = retryPolicy(com.Int(v))
 		case "idle_timeout":
-			c.options.Dialer.Timeout, err = time.ParseDuration(v + "s")
+			c.options.BlockingPoolCleanup, err = time.ParseDuration(v + "s")
 			if err != nil {
 				return fmt.Errorf("error parsing idle timeout: %v", err)
 			}
+		case "dial_timeout":
+			c.options.Dialer.Timeout, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing dial timeout: %v", err)
+			}
+		case "read_timeout", "write_timeout":
+			// rueidis pipelines reads and writes on the same connection
+			// and has a single timeout for both; the larger one wins.
+			timeout, err := time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %v", strings.Replace(k, "_", " ", 1), err)
+			}
+			if timeout > c.options.ConnWriteTimeout {
+				c.options.ConnWriteTimeout = timeout
+			}
+		case "client_cache_ttl":
+			c.cacheTTL, err = time.ParseDuration(v + "s")
+			if err != nil {
+				return fmt.Errorf("error parsing client cache ttl: %v", err)
+			}
+		case "client_cache_max_memory":
+			c.options.CacheSizeEachConn = com.Int(v)
 		case "hset_name":
 			c.hsetName = v
+		case "flush_mode":
+			if v != FlushModeHSet && v != FlushModeScan {
+				return fmt.Errorf("cache/redis: invalid flush_mode '%s'", v)
+			}
+			c.flushMode = v
 		case "prefix":
 			c.prefix = v
 		default:
-			return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			if !tlsOptions.Set(k, v) {
+				return fmt.Errorf("cache/redis: unsupported option '%s'", k)
+			}
 		}
 	}
+	if c.options.TLSConfig, err = tlsOptions.Config(); err != nil {
+		return fmt.Errorf("cache/redis: %v", err)
+	}
+	return nil
+}
 
-	c.client, err = rueidis.NewClient(*c.options)
-	if err != nil {
-		if strings.Contains(err.Error(), `not supporting RESP3`) {
-			c.options.DisableCache = true
-			c.client, err = rueidis.NewClient(*c.options)
-		}
+// unregister removes the keys of this cacher from the hset_name hash left
+// by flush_mode=hset. The hash may be shared with cachers of other
+// prefixes, so only the fields starting with the prefix are deleted; Redis
+// drops the hash itself once its last field is gone.
+func (c *RedisCacher) unregister(ctx context.Context) error {
+	pattern := escapePattern(c.prefix) + "*"
+	var cursor uint64
+	for {
+		entry, err := c.client.Do(ctx, c.client.B().Hscan().Key(c.hsetName).Cursor(cursor).Match(pattern).Count(scanCount).Build()).AsScanEntry()
 		if err != nil {
 			return err
 		}
+		// HSCAN returns fields and values alternately.
+		fields := make([]string, 0, len(entry.Elements)/2)
+		for i := 0; i < len(entry.Elements); i += 2 {
+			fields = append(fields, entry.Elements[i])
+		}
+		if len(fields) > 0 {
+			if err = c.c.HDel(ctx, c.hsetName, fields...).Err(); err != nil {
+				return err
+			}
+		}
+		if cursor = entry.Cursor; cursor == 0 {
+			return nil
+		}
 	}
-	c.c = rueidiscompat.NewAdapter(c.client)
-	return err
 }
 
 func (c *RedisCacher) Close() error {
@@ -2,12 +2,16 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/admpub/cache"
+	"github.com/admpub/cache/internal/tlsconfig/tlsconfigtest"
+	"github.com/redis/rueidis"
 )
 
 func TestCache(t *testing.T) {
@@ -59,3 +63,279 @@ func TestCache(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, true, exist)
 }
+
+func TestFlushScan(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Keys put in hset mode are left with a registry hash.
+	legacy := New()
+	err = legacy.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache[1]:`})
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Put(ctx, "old", "value", 0))
+	assert.True(t, s.Exists("Cache"))
+
+	c := New()
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache[1]:,flush_mode=scan`})
+	assert.NoError(t, err)
+	assert.False(t, s.Exists("Cache"), "the legacy registry is removed")
+
+	for i := 0; i < delBatchSize+10; i++ {
+		assert.NoError(t, c.Put(ctx, fmt.Sprintf("key%d", i), i, 0))
+	}
+	assert.False(t, s.Exists("Cache"))
+	s.Set("cache1:unrelated", "value")
+	assert.NoError(t, c.Flush(ctx))
+	assert.Equal(t, []string{"cache1:unrelated"}, s.Keys())
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,flush_mode=scan`})
+	assert.Error(t, err, "scanning without a prefix would flush the database")
+}
+
+func TestFlushScanSharedHash(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// Cachers of two prefixes record their keys in the same hash.
+	for _, prefix := range []string{"app1:", "app2:"} {
+		legacy := New()
+		err = legacy.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=` + prefix})
+		assert.NoError(t, err)
+		assert.NoError(t, legacy.Put(ctx, "old", "value", 0))
+		legacy.Close()
+	}
+
+	c := New()
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=app1:,flush_mode=scan`})
+	assert.NoError(t, err)
+	defer c.Close()
+	fields, err := s.HKeys("Cache")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app2:old"}, fields, "the keys of other prefixes stay registered")
+
+	c2 := New()
+	err = c2.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=app2:,flush_mode=scan`})
+	assert.NoError(t, err)
+	defer c2.Close()
+	assert.False(t, s.Exists("Cache"), "the emptied registry is removed")
+}
+
+func TestParseConfig(t *testing.T) {
+	c := New().(*RedisCacher)
+	err := c.parseConfig(`addr=10.0.0.1:6379,dial_timeout=2.5,read_timeout=3,write_timeout=4,max_retries=5,min_idle_conns=6`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:6379"}, c.options.InitAddress)
+	assert.Equal(t, 2500*time.Millisecond, c.options.Dialer.Timeout)
+	assert.Equal(t, 4*time.Second, c.options.ConnWriteTimeout)
+	assert.Equal(t, 6, c.options.BlockingPoolMinSize)
+	assert.False(t, c.options.DisableRetry)
+	if assert.NotNil(t, c.options.RetryDelay) {
+		assert.Equal(t, 2*time.Millisecond, c.options.RetryDelay(1, rueidis.Completed{}, nil))
+		assert.Equal(t, time.Duration(-1), c.options.RetryDelay(5, rueidis.Completed{}, nil))
+	}
+
+	err = c.parseConfig(`max_retries=0`)
+	assert.NoError(t, err)
+	assert.False(t, c.options.DisableRetry)
+	assert.Nil(t, c.options.RetryDelay, "the default policy of rueidis is kept")
+
+	err = c.parseConfig(`max_retries=-1`)
+	assert.NoError(t, err)
+	assert.True(t, c.options.DisableRetry)
+
+	assert.Error(t, c.parseConfig(`unknown=1`))
+}
+
+func TestAuthAndTLS(t *testing.T) {
+	files, serverConfig := tlsconfigtest.WriteFiles(t)
+	s, err := miniredis.RunTLS(serverConfig)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	s.RequireUserAuth("app", "secret")
+	ctx := context.Background()
+
+	certs := `,tls_ca_file=` + files.CAFile + `,tls_cert_file=` + files.CertFile + `,tls_key_file=` + files.KeyFile
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,username=app,password=secret,dial_timeout=2,read_timeout=3,write_timeout=4,max_retries=3,min_idle_conns=2,idle_timeout=180` + certs}))
+	defer c.Close()
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+
+	options := c.(*RedisCacher).Options()
+	assert.Equal(t, 2*time.Second, options.Dialer.Timeout)
+	assert.Equal(t, 4*time.Second, options.ConnWriteTimeout)
+	assert.Equal(t, 180*time.Second, options.BlockingPoolCleanup)
+	assert.Equal(t, 2, options.BlockingPoolMinSize)
+	assert.False(t, options.DisableRetry)
+	assert.Equal(t, time.Duration(-1), options.RetryDelay(3, rueidis.Completed{}, nil))
+
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,username=app,password=wrong` + certs})
+	assert.Error(t, err)
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,username=app,password=secret,tls_ca_file=` + files.CAFile})
+	assert.Error(t, err, "the server requires a client certificate")
+	err = New().StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,tls_ca_file=/nonexistent/ca.pem`})
+	assert.Error(t, err)
+}
+
+func TestCounter(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:`}))
+	assert.NoError(t, c.Put(ctx, "counter", int64(1), 3600))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, int64(2), c.Int64(ctx, "counter"))
+	assert.Equal(t, time.Hour, s.TTL("cache:counter"), "the TTL is kept")
+
+	// A missing counter is not created.
+	assert.EqualError(t, c.Incr(ctx, "missing"), "key 'missing' not exist")
+	assert.EqualError(t, c.Decr(ctx, "missing"), "key 'missing' not exist")
+	assert.False(t, s.Exists("cache:missing"))
+
+	assert.NoError(t, c.Put(ctx, "text", "value", 0))
+	assert.Error(t, c.Incr(ctx, "text"))
+
+	// The script is loaded again once the server has forgotten it.
+	client := AsClient(c.Client())
+	assert.NoError(t, client.Do(ctx, client.B().ScriptFlush().Build()).Error())
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.Equal(t, int64(3), c.Int64(ctx, "counter"))
+
+	// Connection errors are reported rather than taken for missing keys.
+	s.Close()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, err = c.IsExist(ctx, "counter")
+	assert.Error(t, err)
+	assert.Error(t, c.Incr(ctx, "counter"))
+}
+
+func TestClientCache(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New().(*RedisCacher)
+	err = c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:,client_cache_ttl=60,client_cache_max_memory=1048576`})
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, time.Minute, c.cacheTTL)
+	assert.Equal(t, 1048576, c.Options().CacheSizeEachConn)
+
+	assert.NoError(t, c.Put(ctx, "a", "first", 0))
+	assert.NoError(t, c.Put(ctx, "b", 2, 0))
+	assert.Equal(t, "first", c.String(ctx, "a"))
+	exist, err := c.IsExist(ctx, "a")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	exist, err = c.IsExist(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	var a string
+	var b int
+	var missing string
+	values := map[string]interface{}{"a": &a, "b": &b, "missing": &missing}
+	assert.NoError(t, c.GetMulti(ctx, values))
+	assert.Equal(t, "first", a)
+	assert.Equal(t, 2, b)
+	assert.Len(t, values, 2)
+	assert.NotContains(t, values, "missing")
+
+	// miniredis has no client tracking, so every read reaches the server.
+	stats := c.ClientCacheStats()
+	assert.Equal(t, uint64(0), stats.Hits)
+	assert.Equal(t, uint64(6), stats.Misses)
+
+	// Without client_cache_ttl nothing is counted.
+	plain := New().(*RedisCacher)
+	assert.NoError(t, plain.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:`}))
+	defer plain.Close()
+	values = map[string]interface{}{"a": &a, "missing": &missing}
+	assert.NoError(t, plain.GetMulti(ctx, values))
+	assert.Len(t, values, 1)
+	assert.Equal(t, ClientCacheStats{}, plain.ClientCacheStats())
+}
+
+type profile struct {
+	Name    string            `cache:"name"`
+	Visits  int64             `cache:"visits"`
+	Labels  map[string]string `cache:"labels"`
+	Comment string            `cache:"-"`
+}
+
+func TestFields(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New()
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: `addr=` + s.Addr() + `,prefix=cache:`}))
+	fc := cache.Fields(c)
+	assert.Same(t, c, fc)
+
+	p := &profile{Name: "A", Visits: 1, Labels: map[string]string{"k": "v"}, Comment: "c"}
+	assert.NoError(t, fc.PutFields(ctx, "profile", p, 3600))
+	assert.Equal(t, "1", s.HGet("cache:profile", "visits"))
+	assert.Equal(t, `{"k":"v"}`, s.HGet("cache:profile", "labels"))
+	assert.True(t, s.Exists("Cache"), "the key is registered for Flush")
+
+	recv := &profile{}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv))
+	assert.Equal(t, &profile{Name: "A", Visits: 1, Labels: map[string]string{"k": "v"}}, recv)
+
+	assert.NoError(t, fc.UpdateField(ctx, "profile", "name", "B"))
+	visits, err := fc.IncrField(ctx, "profile", "visits", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), visits)
+	assert.Equal(t, time.Hour, s.TTL("cache:profile"), "the TTL is kept")
+
+	recv = &profile{}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv, "name", "visits"))
+	assert.Equal(t, &profile{Name: "B", Visits: 3}, recv)
+
+	assert.NoError(t, fc.UpdateField(ctx, "profile", "labels", nil))
+	recv = &profile{Labels: map[string]string{"old": "value"}}
+	assert.NoError(t, fc.GetFields(ctx, "profile", recv, "labels"))
+	assert.Nil(t, recv.Labels)
+
+	assert.Equal(t, cache.ErrNotFound, fc.GetFields(ctx, "missing", recv))
+	assert.Equal(t, cache.ErrNotFound, fc.GetFields(ctx, "profile", recv, "unknown"))
+	assert.Equal(t, cache.ErrNotFound, fc.UpdateField(ctx, "missing", "name", "C"))
+	_, err = fc.IncrField(ctx, "missing", "visits", 1)
+	assert.Equal(t, cache.ErrNotFound, err)
+	assert.False(t, s.Exists("cache:missing"))
+	_, err = fc.IncrField(ctx, "profile", "name", 1)
+	assert.Error(t, err)
+
+	// PutFields replaces the hash.
+	assert.NoError(t, fc.PutFields(ctx, "profile", &profile{Name: "D"}, 0))
+	assert.Equal(t, time.Duration(0), s.TTL("cache:profile"))
+	assert.Equal(t, "0", s.HGet("cache:profile", "visits"))
+
+	assert.NoError(t, c.Flush(ctx))
+	assert.False(t, s.Exists("cache:profile"))
+}
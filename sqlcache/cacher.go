@@ -0,0 +1,367 @@
+package sqlcache
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/webx-top/com"
+
+	"github.com/admpub/cache"
+	"github.com/admpub/cache/encoding"
+)
+
+// Cacher is a cache adapter storing entries in a database/sql table, with
+// the SQL syntax supplied by a Dialect.
+//
+// Every row carries an absolute expires_at computed by the database server;
+// rows put with an expire of 0 have no expires_at and live until deleted.
+type Cacher struct {
+	cache.GetAs
+	codec    encoding.Codec
+	dialect  Dialect
+	driver   string
+	c        *sql.DB
+	owned    bool // c was opened by StartAndGC and is closed by Close
+	table    Table
+	interval int
+	sweep    sweeper
+}
+
+// New returns a cacher that opens its database with the named database/sql
+// driver. StartAndGC takes the driver DSN as AdapterConfig.
+func New(dialect Dialect, driver string) *Cacher {
+	c := &Cacher{codec: cache.DefaultCodec, dialect: dialect, driver: driver, sweep: defaultSweeper}
+	c.GetAs = cache.GetAs{Cache: c}
+	return c
+}
+
+// NewWithDB returns a cacher using db, which stays owned by the caller and
+// is not closed by Close. StartAndGC takes only the adapter options as
+// AdapterConfig, separated by spaces, e.g.
+// "cache_table=sessions cache_gc_batch_size=500".
+func NewWithDB(db *sql.DB, dialect Dialect) *Cacher {
+	c := &Cacher{codec: cache.DefaultCodec, dialect: dialect, c: db, sweep: defaultSweeper}
+	c.GetAs = cache.GetAs{Cache: c}
+	return c
+}
+
+func (c *Cacher) SetCodec(codec encoding.Codec) {
+	c.codec = codec
+}
+
+func (c *Cacher) Codec() encoding.Codec {
+	return c.codec
+}
+
+// Dialect returns the SQL dialect of the cacher.
+func (c *Cacher) Dialect() Dialect {
+	return c.dialect
+}
+
+// Table returns the cache table, known once StartAndGC has succeeded.
+func (c *Cacher) Table() Table {
+	return c.table
+}
+
+func (c *Cacher) md5(key string) string {
+	m := md5.Sum([]byte(key))
+	return hex.EncodeToString(m[:])
+}
+
+// where returns the condition selecting the row of the first argument.
+func (c *Cacher) where() string {
+	return c.dialect.Quote("key") + "=" + c.dialect.Placeholder(1)
+}
+
+// alive returns the condition excluding expired rows.
+func (c *Cacher) alive() string {
+	return "(expires_at IS NULL OR expires_at>" + c.dialect.Now() + ")"
+}
+
+func (c *Cacher) marshal(val interface{}) ([]byte, error) {
+	item := cache.CacheItemPoolGet()
+	item.Val = val
+	data, err := c.codec.Marshal(item)
+	cache.CacheItemPoolRelease(item)
+	return data, err
+}
+
+func (c *Cacher) unmarshal(data []byte, value interface{}) error {
+	item := cache.CacheItemPoolGet()
+	defer cache.CacheItemPoolRelease(item)
+	item.Val = value
+	if err := c.codec.Unmarshal(data, item); err != nil {
+		return err
+	}
+	if item.Val == nil {
+		return cache.ErrNotFound
+	}
+	return nil
+}
+
+// Put puts value into cache with key and expire time.
+// If expired is 0, it lives forever.
+func (c *Cacher) Put(ctx context.Context, key string, val interface{}, expire int64) error {
+	data, err := c.marshal(val)
+	if err != nil {
+		return err
+	}
+
+	// A NULL TTL yields a NULL expires_at in every dialect.
+	var ttl sql.NullInt64
+	if expire > 0 {
+		ttl = sql.NullInt64{Int64: expire, Valid: true}
+	}
+	d := c.dialect
+	query := d.Upsert(c.table,
+		[]string{d.Quote("key"), "data", "created", "expire", "expires_at"},
+		[]string{d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4), d.ExpiresAt(d.Placeholder(5))})
+	_, err = c.c.ExecContext(ctx, query, c.md5(key), data, time.Now().Unix(), expire, ttl)
+	return err
+}
+
+// Get gets cached value by given key.
+// An expired value is still decoded into value along with ErrExpired.
+func (c *Cacher) Get(ctx context.Context, key string, value interface{}) error {
+	var (
+		data    []byte
+		expired int
+	)
+	err := c.c.QueryRowContext(ctx, "SELECT data,CASE WHEN expires_at<="+c.dialect.Now()+" THEN 1 ELSE 0 END FROM "+
+		c.table.String()+" WHERE "+c.where(), c.md5(key)).Scan(&data, &expired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return cache.ErrNotFound
+		}
+		return err
+	}
+	if err = c.unmarshal(data, value); err != nil {
+		return err
+	}
+
+	if expired == 1 {
+		c.Delete(ctx, key)
+		return cache.ErrExpired
+	}
+	return nil
+}
+
+// Delete deletes cached value by given key.
+func (c *Cacher) Delete(ctx context.Context, key string) error {
+	_, err := c.c.ExecContext(ctx, "DELETE FROM "+c.table.String()+" WHERE "+c.where(), c.md5(key))
+	return err
+}
+
+// update applies fn to the int-type value stored under key. The row, or the
+// database for dialects implementing WriteBeginner, is locked for the
+// duration of the update and its expiration is kept.
+func (c *Cacher) update(ctx context.Context, key string, fn func(interface{}) (interface{}, error)) error {
+	if b, ok := c.dialect.(WriteBeginner); ok {
+		return c.updateLocked(ctx, b, key, fn)
+	}
+	tx, err := c.c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = c.modify(ctx, tx, key, fn); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateLocked is update for the dialects implementing WriteBeginner.
+func (c *Cacher) updateLocked(ctx context.Context, b WriteBeginner, key string, fn func(interface{}) (interface{}, error)) (err error) {
+	conn, err := c.c.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = b.BeginWrite(ctx, conn); err != nil {
+		return err
+	}
+	defer func() {
+		end := "COMMIT"
+		if err != nil {
+			end = "ROLLBACK"
+		}
+		if _, endErr := conn.ExecContext(context.Background(), end); endErr != nil {
+			// Discard the connection, which may still be in the transaction.
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			if err == nil {
+				err = endErr
+			}
+		}
+	}()
+	return c.modify(ctx, conn, key, fn)
+}
+
+// execQuerier is implemented by *sql.Tx and *sql.Conn.
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// modify replaces the counter of key by fn(counter) within a transaction.
+func (c *Cacher) modify(ctx context.Context, tx execQuerier, key string, fn func(interface{}) (interface{}, error)) error {
+	var data []byte
+	err := tx.QueryRowContext(ctx, c.dialect.SelectForUpdate(c.table, "data", c.where()+" AND "+c.alive()), c.md5(key)).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return cache.ErrNotFound
+		}
+		return err
+	}
+	var i int64
+	if err = c.unmarshal(data, &i); err != nil {
+		return err
+	}
+
+	val, err := fn(i)
+	if err != nil {
+		return err
+	}
+	if data, err = c.marshal(val); err != nil {
+		return err
+	}
+	d := c.dialect
+	_, err = tx.ExecContext(ctx, "UPDATE "+c.table.String()+" SET data="+d.Placeholder(1)+
+		" WHERE "+d.Quote("key")+"="+d.Placeholder(2), data, c.md5(key))
+	return err
+}
+
+// Incr increases cached int-type value by given key as a counter.
+func (c *Cacher) Incr(ctx context.Context, key string) error {
+	return c.update(ctx, key, cache.Incr)
+}
+
+// Decr decreases cached int-type value by given key as a counter.
+func (c *Cacher) Decr(ctx context.Context, key string) error {
+	return c.update(ctx, key, cache.Decr)
+}
+
+// IsExist returns true if cached value exists and has not expired.
+func (c *Cacher) IsExist(ctx context.Context, key string) (bool, error) {
+	var one int
+	err := c.c.QueryRowContext(ctx, "SELECT 1 FROM "+c.table.String()+" WHERE "+c.where()+" AND "+c.alive(), c.md5(key)).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("cache/%s: error checking existence: %w", c.Name(), err)
+		return false, err
+	}
+	return err != sql.ErrNoRows, nil
+}
+
+// Flush deletes all cached data.
+func (c *Cacher) Flush(ctx context.Context) error {
+	_, err := c.c.ExecContext(ctx, "DELETE FROM "+c.table.String())
+	return err
+}
+
+func (c *Cacher) startGC(ctx context.Context) {
+	if c.interval < 1 {
+		return
+	}
+
+	stats, err := c.GC(ctx)
+	if err != nil {
+		log.Printf("cache/%s: error garbage collecting: %v", c.Name(), err)
+	}
+	if c.sweep.report != nil {
+		c.sweep.report(stats)
+	}
+
+	time.AfterFunc(time.Duration(c.interval)*time.Second, func() { c.startGC(ctx) })
+}
+
+// StartAndGC starts GC routine based on config string settings.
+// AdapterConfig is the driver DSN, which may carry the adapter options
+// cache_table (default cache), cache_schema and the GC settings
+// cache_gc_batch_size, cache_gc_pause and cache_gc_budget, e.g.
+// user:password@tcp(127.0.0.1:3306)/app?charset=utf8mb4&cache_table=sessions
+// Dialects implementing Configurer accept further cache_ options.
+//
+// GC deletes expired rows in batches of cache_gc_batch_size rows (default
+// 1000, 0 deletes them in one statement), sleeping cache_gc_pause (e.g.
+// 100ms) between batches, and leaves the rest to the next run once a sweep
+// has taken cache_gc_budget (e.g. 10s, unlimited by default).
+func (c *Cacher) StartAndGC(ctx context.Context, opt cache.Options) (err error) {
+	c.interval = opt.Interval
+
+	dsn, options := ParseDSN(opt.AdapterConfig)
+	var schema, table = "", "cache"
+	extra := map[string]string{}
+	for k, v := range options {
+		switch k {
+		case "table":
+			table = v
+		case "schema":
+			schema = v
+		case "gc_batch_size":
+			c.sweep.batchSize = com.Int(v)
+		case "gc_pause":
+			if c.sweep.pause, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("cache/%s: error parsing gc pause: %v", c.Name(), err)
+			}
+		case "gc_budget":
+			if c.sweep.budget, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("cache/%s: error parsing gc budget: %v", c.Name(), err)
+			}
+		default:
+			extra[k] = v
+		}
+	}
+	if c.table, err = NewTable(schema, table, c.dialect.Quote); err != nil {
+		return err
+	}
+	configurer, ok := c.dialect.(Configurer)
+	if !ok {
+		for k := range extra {
+			return fmt.Errorf("cache/%s: unsupported option '%s%s'", c.Name(), OptionPrefix, k)
+		}
+	}
+
+	if c.c == nil || c.owned {
+		if c.c, err = sql.Open(c.driver, dsn); err != nil {
+			return err
+		}
+		c.owned = true
+	}
+	if err = c.c.PingContext(ctx); err != nil {
+		return err
+	}
+
+	if err = Migrate(ctx, c.c, c.dialect, c.table, c.dialect.Migrations()); err != nil {
+		return err
+	}
+	if ok {
+		if err = configurer.Configure(ctx, c.c, c.table, extra); err != nil {
+			return err
+		}
+	}
+
+	go c.startGC(ctx)
+	return nil
+}
+
+func (c *Cacher) Close() error {
+	c.interval = 0
+	if c.c == nil || !c.owned {
+		return nil
+	}
+	return c.c.Close()
+}
+
+func (c *Cacher) Client() interface{} {
+	return c.c
+}
+
+func (c *Cacher) Name() string {
+	return c.dialect.Name()
+}
@@ -0,0 +1,264 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+)
+
+// expireNow moves the expiration of key into the past.
+func expireNow(t *testing.T, c *Cacher, db *sql.DB, key string) {
+	_, err := db.Exec("UPDATE "+c.Table().String()+" SET expires_at=expires_at-3600 WHERE key=?", c.md5(key))
+	assert.NoError(t, err)
+}
+
+func TestCacher(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+	assert.Implements(t, (*cache.Cache)(nil), c)
+	assert.Equal(t, "sqlite", c.Name())
+
+	assert.NoError(t, c.Put(ctx, "key", "first", 0))
+	assert.NoError(t, c.Put(ctx, "key", "second", 0))
+	assert.Equal(t, "second", c.String(ctx, "key"))
+	exist, err := c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "missing", &value))
+	exist, err = c.IsExist(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	assert.NoError(t, c.Delete(ctx, "key"))
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "key", &value))
+
+	assert.NoError(t, c.Put(ctx, "a", 1, 0))
+	assert.NoError(t, c.Put(ctx, "b", 2, 0))
+	assert.NoError(t, c.Flush(ctx))
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "a", &value))
+}
+
+func TestCacherCounter(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+
+	assert.NoError(t, c.Put(ctx, "counter", int64(1), 3600))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, int64(2), c.Int64(ctx, "counter"))
+	assert.Equal(t, cache.ErrNotFound, c.Incr(ctx, "missing"))
+	assert.Equal(t, cache.ErrNotFound, c.Decr(ctx, "missing"))
+
+	// The expiration survives the update.
+	var expire int64
+	var expiresAt sql.NullInt64
+	err = db.QueryRow("SELECT expire,expires_at FROM "+c.Table().String()+" WHERE key=?", c.md5("counter")).Scan(&expire, &expiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3600), expire)
+	assert.True(t, expiresAt.Valid)
+
+	expireNow(t, c, db, "counter")
+	assert.Equal(t, cache.ErrNotFound, c.Incr(ctx, "counter"))
+}
+
+func TestCacherConcurrentCounter(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db")+"?_pragma=busy_timeout(10000)")
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+
+	const goroutines, increments = 8, 25
+	assert.NoError(t, c.Put(ctx, "counter", int64(0), 0))
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				assert.NoError(t, c.Incr(ctx, "counter"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(goroutines*increments), c.Int64(ctx, "counter"))
+}
+
+func TestCacherExpiration(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+
+	assert.NoError(t, c.Put(ctx, "forever", "value", 0))
+	assert.NoError(t, c.Put(ctx, "short", "stale", 60))
+	assert.NoError(t, c.Put(ctx, "gone", "value", 60))
+	expireNow(t, c, db, "short")
+	expireNow(t, c, db, "gone")
+
+	exist, err := c.IsExist(ctx, "short")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	var value string
+	assert.Equal(t, cache.ErrExpired, c.Get(ctx, "short", &value))
+	assert.Equal(t, "stale", value)
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "short", &value))
+
+	stats, err := c.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Removed)
+	assert.True(t, stats.Complete)
+	assert.Equal(t, "value", c.String(ctx, "forever"))
+}
+
+func TestCacherBatchedGC(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "cache_gc_batch_size=10 cache_gc_pause=1ms"}))
+	assert.Equal(t, 10, c.sweep.batchSize)
+	assert.Equal(t, time.Millisecond, c.sweep.pause)
+
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, c.Put(ctx, fmt.Sprintf("key%d", i), i, 60))
+	}
+	assert.NoError(t, c.Put(ctx, "alive", "value", 60))
+	_, err = db.Exec("UPDATE "+c.Table().String()+" SET expires_at=expires_at-3600 WHERE key<>?", c.md5("alive"))
+	assert.NoError(t, err)
+
+	stats, err := c.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(25), stats.Removed)
+	assert.Equal(t, 3, stats.Batches)
+	assert.True(t, stats.Complete)
+	assert.Equal(t, "value", c.String(ctx, "alive"))
+
+	// A sweep stops at its budget and leaves the rest to the next one.
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, c.Put(ctx, fmt.Sprintf("key%d", i), i, 60))
+		expireNow(t, c, db, fmt.Sprintf("key%d", i))
+	}
+	c.sweep.pause = 50 * time.Millisecond
+	c.sweep.budget = 10 * time.Millisecond
+	stats, err = c.GC(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), stats.Removed)
+	assert.Equal(t, 1, stats.Batches)
+	assert.False(t, stats.Complete)
+
+	// The background sweep reports its outcome.
+	c.sweep.budget = 0
+	c.sweep.pause = 0
+	reports := make(chan SweepStats, 1)
+	c.SetSweepReporter(func(stats SweepStats) {
+		c.interval = 0
+		reports <- stats
+	})
+	c.interval = 1
+	go c.startGC(ctx)
+	select {
+	case stats = <-reports:
+		assert.Equal(t, int64(15), stats.Removed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sweep reported")
+	}
+}
+
+func TestCacherErrors(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "cache_table=sessions"}))
+	assert.Equal(t, `"sessions"`, c.Table().String())
+
+	// Query errors are reported rather than swallowed.
+	_, err = db.Exec(`DROP TABLE "sessions"`)
+	assert.NoError(t, err)
+	var value string
+	err = c.Get(ctx, "key", &value)
+	assert.Error(t, err)
+	assert.NotEqual(t, cache.ErrNotFound, err)
+	_, err = c.IsExist(ctx, "key")
+	assert.Error(t, err)
+
+	err = NewWithDB(db, SQLite).StartAndGC(ctx, cache.Options{AdapterConfig: "cache_unlogged=true"})
+	assert.EqualError(t, err, "cache/sqlite: unsupported option 'cache_unlogged'")
+	err = NewWithDB(db, SQLite).StartAndGC(ctx, cache.Options{AdapterConfig: "cache_gc_pause=soon"})
+	assert.Error(t, err)
+}
+
+func TestCacherOwnership(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	c := NewWithDB(db, SQLite)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{}))
+	assert.NoError(t, c.Close())
+	assert.NoError(t, db.PingContext(ctx), "a borrowed handle stays open")
+
+	owned := New(SQLite, "sqlite")
+	dsn := filepath.Join(t.TempDir(), "owned.db") + "?cache_table=owned"
+	assert.NoError(t, owned.StartAndGC(ctx, cache.Options{AdapterConfig: dsn}))
+	assert.NoError(t, owned.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", owned.String(ctx, "key"))
+	assert.NoError(t, owned.Close())
+	assert.Error(t, owned.Client().(*sql.DB).PingContext(ctx))
+}
+
+func TestDialectUpsert(t *testing.T) {
+	table, err := NewTable("", "cache", MySQL.Quote)
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO `cache` (`key`,data) VALUES (?,?) ON DUPLICATE KEY UPDATE data=VALUES(data)",
+		MySQL.Upsert(table, []string{"`key`", "data"}, []string{"?", "?"}))
+
+	table, err = NewTable("dbo", "cache", SQLServer.Quote)
+	assert.NoError(t, err)
+	assert.Equal(t, "MERGE INTO [dbo].[cache] WITH (HOLDLOCK) AS dst USING (SELECT @p1 AS [key],@p2 AS data) AS src"+
+		" ON dst.[key]=src.[key] WHEN MATCHED THEN UPDATE SET data=src.data"+
+		" WHEN NOT MATCHED THEN INSERT ([key],data) VALUES (src.[key],src.data);",
+		SQLServer.Upsert(table, []string{"[key]", "data"}, []string{SQLServer.Placeholder(1), SQLServer.Placeholder(2)}))
+	assert.Equal(t, "IF OBJECT_ID(N'dbo.cache', N'U') IS NULL CREATE TABLE [dbo].[cache] (id INT)", SQLServer.CreateTable(table, "id INT"))
+}
+
+func TestDialectDeleteExpired(t *testing.T) {
+	table, err := NewTable("", "cache", PostgreSQL.Quote)
+	assert.NoError(t, err)
+	assert.Equal(t, `DELETE FROM "cache" WHERE expires_at<=now()`, PostgreSQL.DeleteExpired(table, 0))
+	assert.Equal(t, `DELETE FROM "cache" WHERE ctid=ANY(ARRAY(SELECT ctid FROM "cache" WHERE expires_at<=now() LIMIT 500 FOR UPDATE SKIP LOCKED))`,
+		PostgreSQL.DeleteExpired(table, 500))
+
+	table, err = NewTable("", "cache", MySQL.Quote)
+	assert.NoError(t, err)
+	assert.Equal(t, "DELETE FROM `cache` WHERE expires_at<=UNIX_TIMESTAMP() ORDER BY `expires_at` LIMIT 500", MySQL.DeleteExpired(table, 500))
+
+	table, err = NewTable("", "cache", SQLServer.Quote)
+	assert.NoError(t, err)
+	assert.Equal(t, "DELETE TOP (500) FROM [cache] WHERE expires_at<=DATEDIFF_BIG(SECOND,'1970-01-01',SYSUTCDATETIME())", SQLServer.DeleteExpired(table, 500))
+}
@@ -0,0 +1,102 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the SQL syntax of a database flavour. The cache table
+// has the columns key, data, created, expire and expires_at; expires_at holds
+// the absolute expiration in the unit chosen by the dialect and is NULL for
+// entries that live forever.
+type Dialect interface {
+	// Name is the adapter name, e.g. "mysql".
+	Name() string
+	// Quote quotes an identifier.
+	Quote(ident string) string
+	// Placeholder returns the bind parameter of the n-th argument, from 1.
+	Placeholder(n int) string
+	// CreateTable returns a statement creating t with the given column
+	// definitions unless it already exists.
+	CreateTable(t Table, definitions string) string
+	// Migrations returns the schema history of the cache table.
+	Migrations() []Migration
+	// Now returns an expression comparable with expires_at for the current
+	// time, evaluated by the database server.
+	Now() string
+	// ExpiresAt returns an expression computing expires_at from the bind
+	// parameter ttl, which holds a number of seconds or NULL.
+	ExpiresAt(ttl string) string
+	// Upsert returns a statement inserting values into the columns of t,
+	// replacing the row with the same key.
+	Upsert(t Table, columns []string, values []string) string
+	// SelectForUpdate returns a query selecting columns from the rows of t
+	// matching where, locking them until the transaction ends.
+	SelectForUpdate(t Table, columns string, where string) string
+	// DeleteExpired returns a statement deleting at most limit expired rows
+	// of t, or all of them when limit is not positive.
+	DeleteExpired(t Table, limit int) string
+}
+
+// Configurer is implemented by dialects that accept adapter options beyond
+// cache_table and cache_schema. Configure is called once the schema is up to
+// date and must reject options it does not know.
+type Configurer interface {
+	Configure(ctx context.Context, db *sql.DB, t Table, options map[string]string) error
+}
+
+// WriteBeginner is implemented by dialects whose SelectForUpdate takes no
+// lock. Incr and Decr then run on a connection where BeginWrite has begun a
+// transaction holding the write lock before the counter is read, and end it
+// with COMMIT or ROLLBACK.
+type WriteBeginner interface {
+	BeginWrite(ctx context.Context, conn *sql.Conn) error
+}
+
+// questionMarks implements Placeholder for drivers using "?".
+type questionMarks struct{}
+
+func (questionMarks) Placeholder(n int) string {
+	return "?"
+}
+
+// dollarNumbers implements Placeholder for drivers using "$1".
+type dollarNumbers struct{}
+
+func (dollarNumbers) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// ifNotExists implements CreateTable with CREATE TABLE IF NOT EXISTS.
+type ifNotExists struct{}
+
+func (ifNotExists) CreateTable(t Table, definitions string) string {
+	return "CREATE TABLE IF NOT EXISTS " + t.String() + " (" + definitions + ")"
+}
+
+// forUpdate implements SelectForUpdate with a trailing FOR UPDATE clause.
+type forUpdate struct{}
+
+func (forUpdate) SelectForUpdate(t Table, columns string, where string) string {
+	return "SELECT " + columns + " FROM " + t.String() + " WHERE " + where + " FOR UPDATE"
+}
+
+// deleteExpired returns the statement deleting every expired row of t.
+func deleteExpired(d Dialect, t Table) string {
+	return "DELETE FROM " + t.String() + " WHERE expires_at<=" + d.Now()
+}
+
+// onConflict implements Upsert with INSERT ... ON CONFLICT, as supported by
+// PostgreSQL and SQLite.
+type onConflict struct{}
+
+func (d onConflict) Upsert(t Table, columns []string, values []string) string {
+	updates := make([]string, 0, len(columns)-1)
+	for _, col := range columns[1:] {
+		updates = append(updates, col+"=EXCLUDED."+col)
+	}
+	return "INSERT INTO " + t.String() + " (" + strings.Join(columns, ",") + ") VALUES (" + strings.Join(values, ",") +
+		") ON CONFLICT (" + columns[0] + ") DO UPDATE SET " + strings.Join(updates, ",")
+}
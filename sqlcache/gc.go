@@ -0,0 +1,69 @@
+package sqlcache
+
+import (
+	"context"
+	"time"
+)
+
+// SweepStats describes one garbage collection sweep.
+type SweepStats struct {
+	Removed  int64         // expired rows deleted
+	Batches  int           // DELETE statements executed
+	Duration time.Duration // time spent, pauses included
+	// Complete is false when the sweep stopped at its time budget and
+	// expired rows may remain.
+	Complete bool
+}
+
+type sweeper struct {
+	batchSize int
+	pause     time.Duration
+	budget    time.Duration
+	report    func(SweepStats)
+}
+
+var defaultSweeper = sweeper{batchSize: 1000}
+
+// SetSweepReporter sets a function called with the outcome of every
+// background sweep, e.g. to log or export the number of rows removed.
+// It must be set before StartAndGC.
+func (c *Cacher) SetSweepReporter(fn func(SweepStats)) {
+	c.sweep.report = fn
+}
+
+// GC deletes the expired rows batch by batch, as configured with the
+// cache_gc_ options, and reports what the sweep did.
+func (c *Cacher) GC(ctx context.Context) (stats SweepStats, err error) {
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+
+	query := c.dialect.DeleteExpired(c.table, c.sweep.batchSize)
+	for {
+		res, err := c.c.ExecContext(ctx, query)
+		if err != nil {
+			return stats, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return stats, err
+		}
+		stats.Removed += n
+		stats.Batches++
+		if c.sweep.batchSize <= 0 || n < int64(c.sweep.batchSize) {
+			stats.Complete = true
+			return stats, nil
+		}
+		if c.sweep.budget > 0 && time.Since(start)+c.sweep.pause >= c.sweep.budget {
+			return stats, nil
+		}
+		if c.sweep.pause > 0 {
+			t := time.NewTimer(c.sweep.pause)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return stats, ctx.Err()
+			case <-t.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Migration is a versioned change of the cache table schema.
+type Migration struct {
+	Version     int
+	Description string
+	// Statements returns the SQL statements applying the change to t.
+	Statements func(t Table) []string
+}
+
+// Locker is implemented by dialects whose database has advisory locks.
+// Migrate holds the lock of the table while it runs, so that the instances
+// of an application starting together apply every migration once.
+type Locker interface {
+	// Lock blocks until the session of conn holds the lock named name.
+	Lock(ctx context.Context, conn *sql.Conn, name string) error
+	// Unlock releases the lock named name held by the session of conn.
+	Unlock(ctx context.Context, conn *sql.Conn, name string) error
+}
+
+// Migrate brings the schema of t up to date. The applied versions are
+// recorded in the table t_schema_migrations, so every migration runs once.
+//
+// Every migration runs in a transaction with the record of its version, on
+// a single connection holding the lock of t if the dialect is a Locker.
+// Dialects without one must not be migrated concurrently. As DDL commits
+// implicitly on some databases, MySQL among them, a failing migration can
+// leave statements applied without its version, so the statements must be
+// idempotent.
+func Migrate(ctx context.Context, db *sql.DB, d Dialect, t Table, migrations []Migration) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if l, ok := d.(Locker); ok {
+		name := "sqlcache:" + t.Name
+		if len(t.Schema) > 0 {
+			name = "sqlcache:" + t.Schema + "." + t.Name
+		}
+		if err = l.Lock(ctx, conn, name); err != nil {
+			return fmt.Errorf("sqlcache: locking %s: %w", t, err)
+		}
+		defer func() {
+			if err := l.Unlock(context.Background(), conn, name); err != nil {
+				// Discard the connection, which would keep the lock in the pool.
+				conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+		}()
+	}
+
+	versions := t.Related("schema_migrations")
+	if _, err = conn.ExecContext(ctx, d.CreateTable(versions, "version INT NOT NULL PRIMARY KEY, applied BIGINT NOT NULL")); err != nil {
+		return fmt.Errorf("sqlcache: creating %s: %w", versions.Name, err)
+	}
+	var current int
+	if err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version),0) FROM "+versions.String()).Scan(&current); err != nil {
+		return fmt.Errorf("sqlcache: reading schema version: %w", err)
+	}
+
+	pending := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+	for _, m := range pending {
+		if err = apply(ctx, conn, t, versions, m); err != nil {
+			return fmt.Errorf("sqlcache: migration %d (%s): %w", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, t Table, versions Table, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range m.Statements(t) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	// Versions are integers, so they are formatted into the statement to
+	// stay independent of the driver's placeholder syntax.
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version,applied) VALUES (%d,%d)",
+		versions, m.Version, time.Now().Unix())); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,129 @@
+package sqlcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MySQL is the dialect of MySQL and MariaDB. expires_at holds unix seconds.
+var MySQL Dialect = mysqlDialect{}
+
+type mysqlDialect struct {
+	questionMarks
+	ifNotExists
+	forUpdate
+}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Quote(ident string) string {
+	return "`" + ident + "`"
+}
+
+func (mysqlDialect) Migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create cache table",
+			Statements: func(t Table) []string {
+				return []string{"CREATE TABLE IF NOT EXISTS " + t.String() + " (" +
+					"	`key` char(32) NOT NULL," +
+					"	`data` longblob NOT NULL," +
+					"	`created` int(11) unsigned NOT NULL DEFAULT '0'," +
+					"	`expire` int(11) unsigned NOT NULL DEFAULT '0'," +
+					"	PRIMARY KEY (`key`)" +
+					"  ) ENGINE=InnoDB;"}
+			},
+		},
+		{
+			Version:     2,
+			Description: "add indexed expires_at column",
+			Statements: func(t Table) []string {
+				where := "TABLE_SCHEMA=" + mysqlSchema(t) + " AND TABLE_NAME='" + t.Name + "'"
+				stmts := mysqlUnless("SELECT 1 FROM information_schema.COLUMNS WHERE "+where+" AND COLUMN_NAME='expires_at'",
+					"ALTER TABLE "+t.String()+" ADD COLUMN `expires_at` bigint NULL")
+				stmts = append(stmts, "UPDATE "+t.String()+" SET `expires_at`=`created`+`expire` WHERE `expire`>0")
+				return append(stmts, mysqlUnless("SELECT 1 FROM information_schema.STATISTICS WHERE "+where+" AND INDEX_NAME='"+t.Name+"_expires_at'",
+					"CREATE INDEX "+t.Index("expires_at")+" ON "+t.String()+" (`expires_at`)")...)
+			},
+		},
+	}
+}
+
+// mysqlSchema returns the schema of t as an SQL expression.
+func mysqlSchema(t Table) string {
+	if len(t.Schema) == 0 {
+		return "DATABASE()"
+	}
+	return "'" + t.Schema + "'"
+}
+
+// mysqlUnless returns the statements running stmt unless the query exists
+// returns a row, as MySQL has neither ADD COLUMN IF NOT EXISTS nor CREATE
+// INDEX IF NOT EXISTS. The statements must run on the same connection.
+// stmt must not contain single quotes.
+func mysqlUnless(exists string, stmt string) []string {
+	return []string{
+		"SET @sqlcache_stmt=IF(EXISTS(" + exists + "),'DO 0','" + stmt + "')",
+		"PREPARE sqlcache_stmt FROM @sqlcache_stmt",
+		"EXECUTE sqlcache_stmt",
+		"DEALLOCATE PREPARE sqlcache_stmt",
+	}
+}
+
+// Lock takes a named lock with GET_LOCK, whose names are limited to 64
+// characters.
+func (mysqlDialect) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	var ok sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?,-1)", mysqlLockName(name)).Scan(&ok); err != nil {
+		return err
+	}
+	if ok.Int64 != 1 {
+		return fmt.Errorf("GET_LOCK failed for %s", name)
+	}
+	return nil
+}
+
+func (mysqlDialect) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", mysqlLockName(name))
+	return err
+}
+
+func mysqlLockName(name string) string {
+	if len(name) <= 64 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "sqlcache:" + hex.EncodeToString(sum[:20])
+}
+
+func (mysqlDialect) Now() string {
+	return "UNIX_TIMESTAMP()"
+}
+
+func (mysqlDialect) ExpiresAt(ttl string) string {
+	return "UNIX_TIMESTAMP()+" + ttl
+}
+
+func (d mysqlDialect) DeleteExpired(t Table, limit int) string {
+	if limit <= 0 {
+		return deleteExpired(d, t)
+	}
+	return deleteExpired(d, t) + " ORDER BY `expires_at` LIMIT " + strconv.Itoa(limit)
+}
+
+func (mysqlDialect) Upsert(t Table, columns []string, values []string) string {
+	updates := make([]string, 0, len(columns)-1)
+	for _, col := range columns[1:] {
+		updates = append(updates, col+"=VALUES("+col+")")
+	}
+	return "INSERT INTO " + t.String() + " (" + strings.Join(columns, ",") + ") VALUES (" + strings.Join(values, ",") +
+		") ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+}
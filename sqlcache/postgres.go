@@ -0,0 +1,128 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/webx-top/com"
+)
+
+// PostgreSQL is the dialect of PostgreSQL. expires_at is a timestamptz.
+//
+// It accepts the cache_unlogged option: cache_unlogged=true turns the table
+// into an UNLOGGED table, whose writes skip the write-ahead log and are
+// faster, but which is emptied after a crash and is not replicated.
+// cache_unlogged=false turns it back into a regular table.
+var PostgreSQL Dialect = postgresDialect{}
+
+type postgresDialect struct {
+	dollarNumbers
+	ifNotExists
+	forUpdate
+	onConflict
+}
+
+func postgresQuote(ident string) string {
+	return `"` + ident + `"`
+}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Quote(ident string) string {
+	return postgresQuote(ident)
+}
+
+func (postgresDialect) Migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create cache table",
+			Statements: func(t Table) []string {
+				return []string{"CREATE TABLE IF NOT EXISTS " + t.String() + " (" +
+					"	key char(32) NOT NULL PRIMARY KEY," +
+					"	data bytea NOT NULL," +
+					"	created bigint NOT NULL DEFAULT 0," +
+					"	expire bigint NOT NULL DEFAULT 0" +
+					"  )"}
+			},
+		},
+		{
+			Version:     2,
+			Description: "add indexed expires_at column",
+			Statements: func(t Table) []string {
+				return []string{
+					"ALTER TABLE " + t.String() + " ADD COLUMN IF NOT EXISTS expires_at bigint NULL",
+					"UPDATE " + t.String() + " SET expires_at=created+expire WHERE expire>0",
+					"CREATE INDEX IF NOT EXISTS " + t.Index("expires_at") + " ON " + t.String() + " (expires_at)",
+				}
+			},
+		},
+		{
+			Version:     3,
+			Description: "store expires_at as timestamptz",
+			Statements: func(t Table) []string {
+				return []string{
+					"ALTER TABLE " + t.String() + " ALTER COLUMN expires_at TYPE timestamptz USING to_timestamp(expires_at)",
+				}
+			},
+		},
+	}
+}
+
+// Lock takes a session advisory lock, whose key is a hash of name.
+func (postgresDialect) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresLockKey(name))
+	return err
+}
+
+func (postgresDialect) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", postgresLockKey(name))
+	return err
+}
+
+func postgresLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+func (postgresDialect) Now() string {
+	return "now()"
+}
+
+func (postgresDialect) ExpiresAt(ttl string) string {
+	return "now()+" + ttl + "::bigint*interval '1 second'"
+}
+
+// DeleteExpired batches by physical row address, as PostgreSQL has no
+// DELETE ... LIMIT. Rows locked by a concurrent sweep are skipped.
+func (d postgresDialect) DeleteExpired(t Table, limit int) string {
+	if limit <= 0 {
+		return deleteExpired(d, t)
+	}
+	return "DELETE FROM " + t.String() + " WHERE ctid=ANY(ARRAY(SELECT ctid FROM " + t.String() +
+		" WHERE expires_at<=now() LIMIT " + strconv.Itoa(limit) + " FOR UPDATE SKIP LOCKED))"
+}
+
+func (postgresDialect) Configure(ctx context.Context, db *sql.DB, t Table, options map[string]string) error {
+	for k, v := range options {
+		switch k {
+		case "unlogged":
+			persistence := "LOGGED"
+			if com.Bool(v) {
+				persistence = "UNLOGGED"
+			}
+			if _, err := db.ExecContext(ctx, "ALTER TABLE "+t.String()+" SET "+persistence); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cache/postgres: unsupported option '%s%s'", OptionPrefix, k)
+		}
+	}
+	return nil
+}
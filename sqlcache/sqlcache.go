@@ -0,0 +1,102 @@
+// Package sqlcache implements a cache adapter on top of database/sql. The
+// SQL syntax is supplied by a Dialect (MySQL, PostgreSQL, SQLite or
+// SQLServer), and the cacher either opens its own database from the DSN
+// given as AdapterConfig or uses an existing *sql.DB:
+//
+//	c := sqlcache.NewWithDB(db, sqlcache.SQLite)
+//	err := c.StartAndGC(ctx, cache.Options{AdapterConfig: "cache_table=sessions", Interval: 60})
+//
+// The mysql and postgresql packages register the corresponding dialects as
+// cache adapters.
+package sqlcache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// OptionPrefix marks the DSN parameters that configure the cache adapter
+// rather than the database driver, e.g. cache_table=sessions.
+const OptionPrefix = "cache_"
+
+// ParseDSN removes the cache adapter options from dsn and returns the DSN to
+// hand to the driver together with the options, keyed without OptionPrefix.
+// Options are accepted both as URL query parameters
+// (user:pass@tcp(127.0.0.1:3306)/app?cache_table=sessions) and as
+// space-separated key/values (host=localhost dbname=app cache_table=sessions).
+func ParseDSN(dsn string) (string, map[string]string) {
+	options := map[string]string{}
+	if pos := strings.Index(dsn, "?"); pos >= 0 {
+		params := strings.Split(dsn[pos+1:], "&")
+		kept := params[:0]
+		for _, param := range params {
+			if k, v, ok := strings.Cut(param, "="); ok && strings.HasPrefix(k, OptionPrefix) {
+				options[strings.TrimPrefix(k, OptionPrefix)] = v
+				continue
+			}
+			if len(param) > 0 {
+				kept = append(kept, param)
+			}
+		}
+		dsn = dsn[:pos]
+		if len(kept) > 0 {
+			dsn += "?" + strings.Join(kept, "&")
+		}
+		return dsn, options
+	}
+	fields := strings.Fields(dsn)
+	kept := fields[:0]
+	for _, field := range fields {
+		if k, v, ok := strings.Cut(field, "="); ok && strings.HasPrefix(k, OptionPrefix) {
+			options[strings.TrimPrefix(k, OptionPrefix)] = v
+			continue
+		}
+		kept = append(kept, field)
+	}
+	if len(kept) == len(fields) {
+		return dsn, options
+	}
+	return strings.Join(kept, " "), options
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Table names the cache table of an adapter.
+type Table struct {
+	Schema string // optional database schema the table lives in
+	Name   string
+	quote  func(string) string
+}
+
+// NewTable returns the table schema.name, quoting identifiers with quote.
+// Identifiers are restricted to letters, digits and underscores.
+func NewTable(schema string, name string, quote func(string) string) (Table, error) {
+	for _, ident := range []string{schema, name} {
+		if len(ident) > 0 && !identifierRegexp.MatchString(ident) {
+			return Table{}, fmt.Errorf("sqlcache: invalid identifier '%s'", ident)
+		}
+	}
+	if len(name) == 0 {
+		return Table{}, fmt.Errorf("sqlcache: table name is required")
+	}
+	return Table{Schema: schema, Name: name, quote: quote}, nil
+}
+
+// String returns the quoted, schema-qualified table name.
+func (t Table) String() string {
+	if len(t.Schema) == 0 {
+		return t.quote(t.Name)
+	}
+	return t.quote(t.Schema) + "." + t.quote(t.Name)
+}
+
+// Index returns the quoted name of an index on the table.
+func (t Table) Index(suffix string) string {
+	return t.quote(t.Name + "_" + suffix)
+}
+
+// Related returns a table in the same schema whose name is derived from t.
+func (t Table) Related(suffix string) Table {
+	return Table{Schema: t.Schema, Name: t.Name + "_" + suffix, quote: t.quote}
+}
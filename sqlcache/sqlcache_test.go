@@ -0,0 +1,138 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDSN(t *testing.T) {
+	dsn, options := ParseDSN("root:pass@tcp(127.0.0.1:3306)/app?charset=utf8mb4&cache_table=sessions&parseTime=true")
+	assert.Equal(t, "root:pass@tcp(127.0.0.1:3306)/app?charset=utf8mb4&parseTime=true", dsn)
+	assert.Equal(t, map[string]string{"table": "sessions"}, options)
+
+	dsn, options = ParseDSN("postgres://localhost/app?cache_table=sessions&cache_schema=cache")
+	assert.Equal(t, "postgres://localhost/app", dsn)
+	assert.Equal(t, map[string]string{"table": "sessions", "schema": "cache"}, options)
+
+	dsn, options = ParseDSN("host=localhost dbname=app cache_table=sessions sslmode=disable")
+	assert.Equal(t, "host=localhost dbname=app sslmode=disable", dsn)
+	assert.Equal(t, map[string]string{"table": "sessions"}, options)
+
+	dsn, options = ParseDSN("root@/app")
+	assert.Equal(t, "root@/app", dsn)
+	assert.Empty(t, options)
+}
+
+func quote(ident string) string {
+	return `"` + ident + `"`
+}
+
+func TestNewTable(t *testing.T) {
+	table, err := NewTable("public", "cache", quote)
+	assert.NoError(t, err)
+	assert.Equal(t, `"public"."cache"`, table.String())
+	assert.Equal(t, `"cache_expires_at"`, table.Index("expires_at"))
+	assert.Equal(t, `"public"."cache_schema_migrations"`, table.Related("schema_migrations").String())
+
+	for _, name := range []string{"", "cache;DROP TABLE x", "1cache", `ca"che`} {
+		_, err = NewTable("", name, quote)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	table, err := NewTable("", "cache", quote)
+	assert.NoError(t, err)
+
+	migrations := []Migration{
+		{Version: 1, Description: "create", Statements: func(t Table) []string {
+			return []string{"CREATE TABLE " + t.String() + " (key TEXT PRIMARY KEY, created BIGINT)"}
+		}},
+	}
+	assert.NoError(t, Migrate(ctx, db, SQLite, table, migrations))
+	// Applied migrations are skipped.
+	assert.NoError(t, Migrate(ctx, db, SQLite, table, migrations))
+
+	migrations = append(migrations, Migration{Version: 2, Description: "index", Statements: func(t Table) []string {
+		return []string{
+			"ALTER TABLE " + t.String() + " ADD COLUMN expires_at BIGINT NULL",
+			"CREATE INDEX " + t.Index("expires_at") + " ON " + t.String() + " (expires_at)",
+		}
+	}})
+	assert.NoError(t, Migrate(ctx, db, SQLite, table, migrations))
+	_, err = db.ExecContext(ctx, `INSERT INTO "cache" (key,created,expires_at) VALUES ('k',1,2)`)
+	assert.NoError(t, err)
+
+	var version int
+	assert.NoError(t, db.QueryRowContext(ctx, `SELECT MAX(version) FROM "cache_schema_migrations"`).Scan(&version))
+	assert.Equal(t, 2, version)
+
+	// A failing migration is rolled back and not recorded.
+	migrations = append(migrations, Migration{Version: 3, Description: "broken", Statements: func(t Table) []string {
+		return []string{"ALTER TABLE " + t.String() + " ADD COLUMN extra TEXT", "NOT SQL"}
+	}})
+	assert.Error(t, Migrate(ctx, db, SQLite, table, migrations))
+	assert.NoError(t, db.QueryRowContext(ctx, `SELECT MAX(version) FROM "cache_schema_migrations"`).Scan(&version))
+	assert.Equal(t, 2, version)
+}
+
+// lockingSQLite records the locks taken by Migrate.
+type lockingSQLite struct {
+	sqliteDialect
+	calls *[]string
+}
+
+func (d lockingSQLite) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	*d.calls = append(*d.calls, "lock "+name)
+	return nil
+}
+
+func (d lockingSQLite) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	*d.calls = append(*d.calls, "unlock "+name)
+	return nil
+}
+
+func TestMigrateLock(t *testing.T) {
+	for _, d := range []Dialect{MySQL, PostgreSQL, SQLServer} {
+		_, ok := d.(Locker)
+		assert.True(t, ok, d.Name())
+	}
+
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	table, err := NewTable("", "cache", quote)
+	assert.NoError(t, err)
+	var calls []string
+	d := lockingSQLite{calls: &calls}
+	assert.NoError(t, Migrate(ctx, db, d, table, d.Migrations()))
+	assert.Error(t, Migrate(ctx, db, d, table, []Migration{{Version: 2, Statements: func(t Table) []string {
+		return []string{"NOT SQL"}
+	}}}))
+	assert.Equal(t, []string{"lock sqlcache:cache", "unlock sqlcache:cache", "lock sqlcache:cache", "unlock sqlcache:cache"}, calls)
+}
+
+func TestMySQLMigrations(t *testing.T) {
+	table, err := NewTable("app", "cache", MySQL.Quote)
+	assert.NoError(t, err)
+	stmts := MySQL.Migrations()[1].Statements(table)
+	assert.Len(t, stmts, 9)
+	assert.Equal(t, "SET @sqlcache_stmt=IF(EXISTS(SELECT 1 FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='app' AND TABLE_NAME='cache'"+
+		" AND COLUMN_NAME='expires_at'),'DO 0','ALTER TABLE `app`.`cache` ADD COLUMN `expires_at` bigint NULL')", stmts[0])
+	assert.Len(t, mysqlLockName("sqlcache:"+strings.Repeat("x", 64)), 49)
+}
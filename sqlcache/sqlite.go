@@ -0,0 +1,74 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// SQLite is the dialect of SQLite. expires_at holds unix seconds. Row locks
+// do not exist in SQLite, so Incr and Decr take the database write lock with
+// BEGIN IMMEDIATE before reading the counter. Concurrent writers wait for
+// the lock only when the connection has a busy timeout, e.g.
+// _pragma=busy_timeout(5000) in the DSN of github.com/glebarez/go-sqlite.
+var SQLite Dialect = sqliteDialect{}
+
+type sqliteDialect struct {
+	questionMarks
+	ifNotExists
+	onConflict
+}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Quote(ident string) string {
+	return postgresQuote(ident)
+}
+
+func (sqliteDialect) Migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create cache table",
+			Statements: func(t Table) []string {
+				return []string{
+					"CREATE TABLE IF NOT EXISTS " + t.String() + " (" +
+						"	key TEXT NOT NULL PRIMARY KEY," +
+						"	data BLOB NOT NULL," +
+						"	created INTEGER NOT NULL DEFAULT 0," +
+						"	expire INTEGER NOT NULL DEFAULT 0," +
+						"	expires_at INTEGER NULL" +
+						"  )",
+					"CREATE INDEX IF NOT EXISTS " + t.Index("expires_at") + " ON " + t.String() + " (expires_at)",
+				}
+			},
+		},
+	}
+}
+
+func (sqliteDialect) Now() string {
+	return "CAST(strftime('%s','now') AS INTEGER)"
+}
+
+func (d sqliteDialect) ExpiresAt(ttl string) string {
+	return d.Now() + "+" + ttl
+}
+
+func (sqliteDialect) SelectForUpdate(t Table, columns string, where string) string {
+	return "SELECT " + columns + " FROM " + t.String() + " WHERE " + where
+}
+
+func (sqliteDialect) BeginWrite(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	return err
+}
+
+func (d sqliteDialect) DeleteExpired(t Table, limit int) string {
+	if limit <= 0 {
+		return deleteExpired(d, t)
+	}
+	return "DELETE FROM " + t.String() + " WHERE rowid IN (SELECT rowid FROM " + t.String() +
+		" WHERE expires_at<=" + d.Now() + " LIMIT " + strconv.Itoa(limit) + ")"
+}
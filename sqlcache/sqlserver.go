@@ -0,0 +1,114 @@
+package sqlcache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SQLServer is the dialect of Microsoft SQL Server 2016 and later.
+// expires_at holds unix seconds.
+var SQLServer Dialect = sqlserverDialect{}
+
+type sqlserverDialect struct{}
+
+func (sqlserverDialect) Name() string {
+	return "sqlserver"
+}
+
+func (sqlserverDialect) Quote(ident string) string {
+	return "[" + ident + "]"
+}
+
+func (sqlserverDialect) Placeholder(n int) string {
+	return "@p" + strconv.Itoa(n)
+}
+
+// sqlserverObject returns the unquoted name of t, as taken by OBJECT_ID.
+func sqlserverObject(t Table) string {
+	if len(t.Schema) > 0 {
+		return t.Schema + "." + t.Name
+	}
+	return t.Name
+}
+
+func (sqlserverDialect) CreateTable(t Table, definitions string) string {
+	return "IF OBJECT_ID(N'" + sqlserverObject(t) + "', N'U') IS NULL CREATE TABLE " + t.String() + " (" + definitions + ")"
+}
+
+func (d sqlserverDialect) Migrations() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create cache table",
+			Statements: func(t Table) []string {
+				return []string{
+					d.CreateTable(t, "[key] CHAR(32) NOT NULL PRIMARY KEY,"+
+						" data VARBINARY(MAX) NOT NULL,"+
+						" created BIGINT NOT NULL DEFAULT 0,"+
+						" expire BIGINT NOT NULL DEFAULT 0,"+
+						" expires_at BIGINT NULL"),
+					"IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name=N'" + t.Name + "_expires_at' AND object_id=OBJECT_ID(N'" + sqlserverObject(t) + "'))" +
+						" CREATE INDEX " + t.Index("expires_at") + " ON " + t.String() + " (expires_at)",
+				}
+			},
+		},
+	}
+}
+
+// Lock takes an application lock owned by the session.
+func (sqlserverDialect) Lock(ctx context.Context, conn *sql.Conn, name string) error {
+	var status int
+	if err := conn.QueryRowContext(ctx, "DECLARE @r int;"+
+		" EXEC @r=sp_getapplock @Resource=@p1, @LockMode='Exclusive', @LockOwner='Session', @LockTimeout=-1;"+
+		" SELECT @r", name).Scan(&status); err != nil {
+		return err
+	}
+	if status < 0 {
+		return fmt.Errorf("sp_getapplock failed for %s with status %d", name, status)
+	}
+	return nil
+}
+
+func (sqlserverDialect) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "EXEC sp_releaseapplock @Resource=@p1, @LockOwner='Session'", name)
+	return err
+}
+
+func (sqlserverDialect) Now() string {
+	return "DATEDIFF_BIG(SECOND,'1970-01-01',SYSUTCDATETIME())"
+}
+
+func (d sqlserverDialect) ExpiresAt(ttl string) string {
+	return d.Now() + "+" + ttl
+}
+
+func (sqlserverDialect) Upsert(t Table, columns []string, values []string) string {
+	sources := make([]string, len(columns))
+	updates := make([]string, 0, len(columns)-1)
+	inserts := make([]string, len(columns))
+	for i, col := range columns {
+		sources[i] = values[i] + " AS " + col
+		inserts[i] = "src." + col
+		if i > 0 {
+			updates = append(updates, col+"=src."+col)
+		}
+	}
+	return "MERGE INTO " + t.String() + " WITH (HOLDLOCK) AS dst USING (SELECT " + strings.Join(sources, ",") + ") AS src" +
+		" ON dst." + columns[0] + "=src." + columns[0] +
+		" WHEN MATCHED THEN UPDATE SET " + strings.Join(updates, ",") +
+		" WHEN NOT MATCHED THEN INSERT (" + strings.Join(columns, ",") + ") VALUES (" + strings.Join(inserts, ",") + ");"
+}
+
+func (sqlserverDialect) SelectForUpdate(t Table, columns string, where string) string {
+	return "SELECT " + columns + " FROM " + t.String() + " WITH (UPDLOCK, ROWLOCK) WHERE " + where
+}
+
+func (d sqlserverDialect) DeleteExpired(t Table, limit int) string {
+	if limit <= 0 {
+		return deleteExpired(d, t)
+	}
+	return "DELETE TOP (" + strconv.Itoa(limit) + ") FROM " + t.String() + " WHERE expires_at<=" + d.Now()
+}
@@ -0,0 +1,10 @@
+//go:build sqlitecgo
+
+package sqlite
+
+import "net/url"
+
+// setPragma adds a pragma to the query of a github.com/mattn/go-sqlite3 URI.
+func setPragma(query url.Values, name string, value string) {
+	query.Set("_"+name, value)
+}
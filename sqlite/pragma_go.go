@@ -0,0 +1,10 @@
+//go:build !sqlitecgo
+
+package sqlite
+
+import "net/url"
+
+// setPragma adds a pragma to the query of a github.com/glebarez/go-sqlite URI.
+func setPragma(query url.Values, name string, value string) {
+	query.Add("_pragma", name+"("+value+")")
+}
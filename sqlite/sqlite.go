@@ -5,14 +5,22 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/webx-top/com"
+
 	"github.com/admpub/cache"
 	"github.com/admpub/cache/encoding"
 	"github.com/admpub/cove"
 	_ "github.com/admpub/cove/driver"
+	"github.com/admpub/ini"
 )
 
 // SQLiteCacher represents a SQLite cache adapter implementation.
@@ -100,7 +108,7 @@ func (c *SQLiteCacher) Incr(ctx context.Context, key string) error {
 // Decr cached int value.
 func (c *SQLiteCacher) Decr(ctx context.Context, key string) error {
 	var i int64
-	err := c.read(key, i)
+	err := c.read(key, &i)
 	if err != nil {
 		return err
 	}
@@ -124,22 +132,152 @@ func (c *SQLiteCacher) Flush(ctx context.Context) error {
 	return err
 }
 
+// MemoryPath selects an in-memory database, private to the cacher and shared
+// by its connections. It is lost on Close.
+const MemoryPath = ":memory:"
+
+// memorySeq names the in-memory databases of the process.
+var memorySeq uint64
+
+var (
+	journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	syncLevels   = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// config holds the settings parsed from AdapterConfig.
+type config struct {
+	path          string
+	journalMode   string
+	synchronous   string
+	busyTimeout   int // milliseconds
+	defaultTTL    int64
+	vacuumBatch   int
+	removeOnClose bool
+}
+
+func parseConfig(adapterConfig string) (*config, error) {
+	conf := &config{path: adapterConfig, vacuumBatch: 1_000}
+	if !strings.Contains(adapterConfig, "=") {
+		return conf, nil
+	}
+	cfg, err := ini.Load([]byte(strings.Replace(adapterConfig, ",", "\n", -1)))
+	if err != nil {
+		return nil, err
+	}
+	conf.path = ""
+	for k, v := range cfg.Section("").KeysHash() {
+		switch k {
+		case "path":
+			conf.path = v
+		case "journal_mode":
+			if conf.journalMode, err = oneOf(k, v, journalModes); err != nil {
+				return nil, err
+			}
+		case "synchronous":
+			if conf.synchronous, err = oneOf(k, v, syncLevels); err != nil {
+				return nil, err
+			}
+		case "busy_timeout":
+			conf.busyTimeout = com.Int(v)
+		case "default_ttl":
+			conf.defaultTTL = com.Int64(v)
+		case "vacuum_batch":
+			conf.vacuumBatch = com.Int(v)
+			if conf.vacuumBatch <= 0 {
+				return nil, fmt.Errorf("cache/sqlite: invalid vacuum_batch '%s'", v)
+			}
+		case "remove_on_close":
+			conf.removeOnClose = com.Bool(v)
+		default:
+			return nil, fmt.Errorf("cache/sqlite: unsupported option '%s'", k)
+		}
+	}
+	return conf, nil
+}
+
+func oneOf(name string, value string, allowed []string) (string, error) {
+	value = strings.ToUpper(value)
+	for _, v := range allowed {
+		if v == value {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("cache/sqlite: invalid %s '%s', expected one of %s", name, value, strings.Join(allowed, ", "))
+}
+
+// uri returns the database URI. The pragmas are passed to the driver so that
+// every pooled connection applies them.
+func (conf *config) uri() string {
+	var uri string
+	query := url.Values{}
+	if conf.path == MemoryPath {
+		uri = fmt.Sprintf("file:admpub-cache-%d-%d", os.Getpid(), atomic.AddUint64(&memorySeq, 1))
+		query.Set("mode", "memory")
+		query.Set("cache", "shared")
+	} else {
+		uri = cove.URIFromPath(conf.path)
+	}
+	if conf.busyTimeout > 0 {
+		setPragma(query, "busy_timeout", com.String(conf.busyTimeout))
+	}
+	if len(conf.journalMode) > 0 {
+		setPragma(query, "journal_mode", conf.journalMode)
+	}
+	if len(conf.synchronous) > 0 {
+		setPragma(query, "synchronous", conf.synchronous)
+	}
+	if len(query) == 0 {
+		return uri
+	}
+	return uri + "?" + query.Encode()
+}
+
 // StartAndGC starts GC routine based on config string settings.
+// AdapterConfig is either the path of the database file or key/values:
+// path=./data/cache.db,journal_mode=WAL,synchronous=NORMAL,busy_timeout=5000,default_ttl=600,vacuum_batch=1000,remove_on_close=false
+//
+// journal_mode and synchronous take the values of the SQLite pragmas of the
+// same name, busy_timeout is in milliseconds and default_ttl, in seconds,
+// applies to values put with an expire of 0. Expired rows are vacuumed every
+// Interval seconds, vacuum_batch rows at a time. remove_on_close deletes the
+// database files on Close.
+//
+// path=:memory: keeps the data in memory, which suits hermetic tests.
+// Without a path the database is created at <TempDir>/admpub/cache.db, which
+// every process of the host shares and the system may clean up. This
+// fallback is deprecated and logs a warning; set path instead.
 func (c *SQLiteCacher) StartAndGC(ctx context.Context, opt cache.Options) (err error) {
-	c.interval = opt.Interval
-	ops := []cove.Op{
-		//cove.DBRemoveOnClose(),
-		//cove.WithTTL(time.Minute*10),
+	conf, err := parseConfig(opt.AdapterConfig)
+	if err != nil {
+		return err
 	}
+	if len(conf.path) == 0 {
+		conf.path = filepath.Join(os.TempDir(), `admpub/cache.db`)
+		log.Printf("cache/sqlite: no path configured, falling back to the deprecated default %s", conf.path)
+	}
+
+	c.interval = opt.Interval
+	ops := []cove.Op{}
 	if c.interval > 0 {
-		ops = append(ops, cove.WithVacuum(cove.Vacuum(time.Duration(c.interval)*time.Second, 1_000)))
+		ops = append(ops, cove.WithVacuum(cove.Vacuum(time.Duration(c.interval)*time.Second, conf.vacuumBatch)))
 	} else {
 		ops = append(ops, cove.WithVacuum(nil))
 	}
-	if len(opt.AdapterConfig) == 0 {
-		opt.AdapterConfig = filepath.Join(os.TempDir(), `admpub/cache.db`)
+	// cove switches the connection it opens with to WAL and NORMAL, set
+	// them back to the configured values.
+	if len(conf.journalMode) > 0 {
+		ops = append(ops, cove.DBPragma("journal_mode = "+conf.journalMode))
+	}
+	if len(conf.synchronous) > 0 {
+		ops = append(ops, cove.DBPragma("synchronous = "+conf.synchronous))
+	}
+	if conf.defaultTTL > 0 {
+		ops = append(ops, cove.WithTTL(time.Duration(conf.defaultTTL)*time.Second))
+	}
+	if conf.removeOnClose && conf.path != MemoryPath {
+		ops = append(ops, cove.DBRemoveOnClose())
 	}
-	c.c, err = cove.New(cove.URIFromPath(opt.AdapterConfig), ops...)
+	c.c, err = cove.New(conf.uri(), ops...)
 	return err
 }
 
@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/admpub/cache"
+)
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*SQLiteCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=:memory:"}))
+	defer c.Close()
+	assert.Implements(t, (*cache.Cache)(nil), c)
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+	exist, err := c.IsExist(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	assert.NoError(t, c.Put(ctx, "counter", int64(1), 0))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Incr(ctx, "counter"))
+	assert.NoError(t, c.Decr(ctx, "counter"))
+	assert.Equal(t, int64(2), c.Int64(ctx, "counter"))
+
+	assert.NoError(t, c.Delete(ctx, "key"))
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "key", &value))
+	assert.NoError(t, c.Flush(ctx))
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "counter", &value))
+}
+
+func TestSQLiteMemoryIsolation(t *testing.T) {
+	ctx := context.Background()
+	a := New().(*SQLiteCacher)
+	assert.NoError(t, a.StartAndGC(ctx, cache.Options{AdapterConfig: "path=:memory:"}))
+	defer a.Close()
+	b := New().(*SQLiteCacher)
+	assert.NoError(t, b.StartAndGC(ctx, cache.Options{AdapterConfig: "path=:memory:,journal_mode=memory,synchronous=off"}))
+	defer b.Close()
+
+	assert.NoError(t, a.Put(ctx, "key", "a", 0))
+	var value string
+	assert.Equal(t, cache.ErrNotFound, b.Get(ctx, "key", &value))
+	assert.Equal(t, "a", a.String(ctx, "key"))
+}
+
+func TestSQLiteDefaultTTL(t *testing.T) {
+	ctx := context.Background()
+	c := New().(*SQLiteCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=:memory:,default_ttl=1"}))
+	defer c.Close()
+
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	assert.Equal(t, "value", c.String(ctx, "key"))
+	time.Sleep(1100 * time.Millisecond)
+	var value string
+	assert.Equal(t, cache.ErrNotFound, c.Get(ctx, "key", &value))
+}
+
+func TestSQLiteRemoveOnClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := New().(*SQLiteCacher)
+	err := c.StartAndGC(ctx, cache.Options{AdapterConfig: "path=" + path + ",journal_mode=wal,busy_timeout=5000,remove_on_close=true"})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Put(ctx, "key", "value", 0))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// A plain path is still accepted and kept on Close.
+	c = New().(*SQLiteCacher)
+	assert.NoError(t, c.StartAndGC(ctx, cache.Options{AdapterConfig: path}))
+	assert.NoError(t, c.Close())
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestSQLiteConfig(t *testing.T) {
+	conf, err := parseConfig("path=/tmp/cache.db,journal_mode=wal,synchronous=normal,busy_timeout=5000,vacuum_batch=50")
+	assert.NoError(t, err)
+	assert.Equal(t, "WAL", conf.journalMode)
+	assert.Equal(t, "NORMAL", conf.synchronous)
+	assert.Equal(t, 5000, conf.busyTimeout)
+	assert.Equal(t, 50, conf.vacuumBatch)
+	assert.Contains(t, conf.uri(), "busy_timeout")
+
+	for _, config := range []string{"journal_mode=fast", "synchronous=sometimes", "vacuum_batch=0", "unknown=1"} {
+		_, err = parseConfig(config)
+		assert.Error(t, err, config)
+	}
+}